@@ -0,0 +1,273 @@
+package main
+
+// -------------------------
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+const maxRecentRequests = 100
+
+// -------------------------
+// AdminConfig 定義本機管理 API 的監聽位址與存取 Token
+type AdminConfig struct {
+	Listen string `json:"listen"` // 例如 127.0.0.1:18900 或 unix:/run/netpass.sock，空值代表停用
+	Token  string `json:"token"`  // 設定後每個請求都須帶 Authorization: Bearer <token>
+}
+
+// -------------------------
+// requestRecord 記錄一筆最近處理過的請求
+type requestRecord struct {
+	Time     time.Time `json:"time"`
+	Profile  string    `json:"profile"`
+	Kind     string    `json:"kind"`    // http / websocket / tcp
+	Session  string    `json:"session"` // Broker 的 SessionID 或隧道 Token
+	Target   string    `json:"target"`  // 本地 (或區網) 連線位址
+	Detail   string    `json:"detail"`  // HTTP 方法與路徑，或拒絕原因
+	Status   int       `json:"status"`  // HTTP 狀態碼，隧道為 0
+	Duration string    `json:"duration"`
+}
+
+// -------------------------
+var requestLock sync.Mutex
+var recentRequests []requestRecord
+var startedAt = time.Now()
+
+// -------------------------
+// recordRequest 將請求加入最近請求清單，只保留最後 maxRecentRequests 筆
+func recordRequest(profile string, kind string, session string, target string, detail string, status int, started time.Time) {
+	requestLock.Lock()
+	defer requestLock.Unlock()
+
+	recentRequests = append(recentRequests, requestRecord{
+		Time:     started,
+		Profile:  profile,
+		Kind:     kind,
+		Session:  session,
+		Target:   target,
+		Detail:   detail,
+		Status:   status,
+		Duration: time.Since(started).Round(time.Millisecond).String(),
+	})
+	if len(recentRequests) > maxRecentRequests {
+		recentRequests = recentRequests[len(recentRequests)-maxRecentRequests:]
+	}
+}
+
+// -------------------------
+// listenAdmin 依設定建立 TCP (僅限 loopback) 或 Unix Socket 監聽
+func listenAdmin(address string) (net.Listener, error) {
+	if _path, ok := strings.CutPrefix(address, "unix:"); ok {
+		os.Remove(_path)
+		return listenUnix(_path)
+	}
+
+	_host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _ip := net.ParseIP(_host); _host != "localhost" && (_ip == nil || !_ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin.listen must be a loopback address or unix socket, got %q", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// -------------------------
+// startAdminServer 啟動本機管理 API，未設定 admin.listen 時不啟動
+func startAdminServer() {
+	_address := strings.TrimSpace(currentConfig().Admin.Listen)
+	if _address == "" {
+		return
+	}
+
+	// 本機的任何使用者都能連上 TCP Port，沒有 Token 時不提供 /shutdown 等操作；Unix Socket 由檔案權限限制
+	if !strings.HasPrefix(_address, "unix:") && currentConfig().Admin.Token == "" {
+		logErrorf("[Admin] admin.token is required to listen on %s, admin API disabled", _address)
+		return
+	}
+
+	_listener, err := listenAdmin(_address)
+	if err != nil {
+		logErrorf("[Admin] Failed to listen on %s: %v", _address, err)
+		return
+	}
+	logInfof("[Admin] Listening on %s", _address)
+
+	go http.Serve(_listener, adminGuard(newAdminMux()))
+}
+
+// -------------------------
+// adminGuard 拒絕瀏覽器發出的請求 (帶 Origin、跨站的 Sec-Fetch-Site 或非本機的 Host)，
+// 避免任意網頁以 CSRF 或 DNS Rebinding 呼叫 /shutdown 等操作；設定 admin.token 時另外檢查 Bearer Token
+func adminGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_site := r.Header.Get("Sec-Fetch-Site")
+		if r.Header.Get("Origin") != "" || (_site != "" && _site != "none") {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "browser requests are not allowed"})
+			return
+		}
+		if !isLocalHostHeader(r.Host) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "unexpected Host header"})
+			return
+		}
+		if _token := currentConfig().Admin.Token; _token != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+_token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing admin token"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// -------------------------
+// isLocalHostHeader 判斷 Host Header 是否指向本機 (localhost、loopback IP 或 Unix Socket 用的 netpass)
+func isLocalHostHeader(host string) bool {
+	if _host, _, err := net.SplitHostPort(host); err == nil {
+		host = _host
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") || host == "netpass" {
+		return true
+	}
+	_ip := net.ParseIP(host)
+	return _ip != nil && _ip.IsLoopback()
+}
+
+// -------------------------
+// newAdminMux 建立管理 API 的路由
+func newAdminMux() *http.ServeMux {
+	_mux := http.NewServeMux()
+
+	_mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, adminStatus())
+	})
+
+	_mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, r *http.Request) {
+		_kind := r.URL.Query().Get("kind")
+
+		sessionLock.Lock()
+		_list := make([]activeSession, 0, len(activeSessions))
+		for _, _s := range activeSessions {
+			if _kind == "" || _s.Kind == _kind {
+				_list = append(_list, *_s)
+			}
+		}
+		sessionLock.Unlock()
+
+		sort.Slice(_list, func(i, j int) bool { return _list[i].ID < _list[j].ID })
+		writeJSON(w, http.StatusOK, _list)
+	})
+
+	_mux.HandleFunc("GET /requests", func(w http.ResponseWriter, r *http.Request) {
+		requestLock.Lock()
+		_list := append([]requestRecord{}, recentRequests...)
+		requestLock.Unlock()
+		writeJSON(w, http.StatusOK, _list)
+	})
+
+	_mux.HandleFunc("GET /metrics", metricsHandler)
+
+	_mux.HandleFunc("POST /reconnect", func(w http.ResponseWriter, r *http.Request) {
+		logInfof("[Admin] Reconnect requested")
+		go reconnectTunnels()
+		writeJSON(w, http.StatusAccepted, map[string]string{"result": "reconnecting"})
+	})
+
+	_mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		logInfof("[Admin] Reload requested")
+		if err := reloadConfig("admin request"); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "reloaded"})
+	})
+
+	_mux.HandleFunc("POST /shutdown", func(w http.ResponseWriter, r *http.Request) {
+		logInfof("[Admin] Shutdown requested")
+		writeJSON(w, http.StatusAccepted, map[string]string{"result": "shutting down"})
+		go shutdown("admin request")
+	})
+
+	return _mux
+}
+
+// -------------------------
+// adminStatus 回傳目前的連線狀態
+func adminStatus() map[string]any {
+	_running := runningProfiles()
+	_profiles := make([]map[string]any, 0, len(_running))
+	for _, _p := range _running {
+		_config := _p.settings()
+		_profiles = append(_profiles, map[string]any{
+			"id":         _config.ID,
+			"hw_id":      _p.assignedID(),
+			"name":       _config.Name,
+			"host":       _config.Host,
+			"public_url": _p.publicURL(),
+			"connected":  _p.connected(),
+		})
+	}
+
+	return map[string]any{
+		"version":         defaultVersion,
+		"instance":        currentConfig().instanceName(),
+		"pid":             os.Getpid(),
+		"profiles":        _profiles,
+		"draining":        isDraining(),
+		"active_sessions": activeSessionCount(),
+		"uptime":          time.Since(startedAt).Round(time.Second).String(),
+	}
+}
+
+// -------------------------
+// adminClient 建立連線到管理 API 的 HTTP Client 與基底網址，支援 unix: 位址
+// 設定 admin.token 時每個請求自動帶上 Bearer Token
+func adminClient(address string) (*http.Client, string) {
+	_transport := &http.Transport{}
+	_base := "http://" + address
+	if _path, ok := strings.CutPrefix(address, "unix:"); ok {
+		_transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", _path)
+		}
+		_base = "http://netpass"
+	}
+	_client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: adminTransport{token: currentConfig().Admin.Token, next: _transport},
+	}
+	return _client, _base
+}
+
+// -------------------------
+// adminTransport 在請求加上管理 API 的 Token
+type adminTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+// -------------------------
+func (_this adminTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _this.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+_this.token)
+	}
+	return _this.next.RoundTrip(req)
+}
+
+// -------------------------
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
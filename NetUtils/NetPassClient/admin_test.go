@@ -0,0 +1,83 @@
+package main
+
+// -------------------------
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// -------------------------
+func TestAdminGuard(t *testing.T) {
+	_tests := []struct {
+		name   string
+		token  string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"loopback", "", "127.0.0.1:18900", nil, http.StatusOK},
+		{"localhost", "", "localhost:18900", nil, http.StatusOK},
+		{"unix socket", "", "netpass", nil, http.StatusOK},
+		{"browser origin", "", "127.0.0.1:18900", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"cross site fetch", "", "127.0.0.1:18900", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"typed into the address bar", "", "127.0.0.1:18900", map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"dns rebinding", "", "evil.example.com:18900", nil, http.StatusForbidden},
+		{"missing token", "secret", "127.0.0.1:18900", nil, http.StatusUnauthorized},
+		{"wrong token", "secret", "127.0.0.1:18900", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"token", "secret", "127.0.0.1:18900", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+	}
+	_handler := adminGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			useConfig(t, Config{Admin: AdminConfig{Listen: "127.0.0.1:18900", Token: _tt.token}})
+
+			_req := httptest.NewRequest(http.MethodPost, "/shutdown", nil)
+			_req.Host = _tt.host
+			for _k, _v := range _tt.header {
+				_req.Header.Set(_k, _v)
+			}
+			_rec := httptest.NewRecorder()
+			_handler.ServeHTTP(_rec, _req)
+			if _rec.Code != _tt.want {
+				t.Fatalf("got %d, want %d", _rec.Code, _tt.want)
+			}
+		})
+	}
+}
+
+// -------------------------
+func TestListenAdminUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions are controlled by ACLs on Windows")
+	}
+	_path := filepath.Join(t.TempDir(), "admin.sock")
+	_listener, err := listenAdmin("unix:" + _path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer _listener.Close()
+
+	_info, err := os.Stat(_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _mode := _info.Mode().Perm(); _mode != 0600 {
+		t.Fatalf("socket created with mode %o, want 600", _mode)
+	}
+}
+
+// -------------------------
+func TestListenAdminRejectsRemoteAddress(t *testing.T) {
+	for _, _address := range []string{"0.0.0.0:18900", "192.168.1.10:18900", "example.com:18900"} {
+		if _listener, err := listenAdmin(_address); err == nil {
+			_listener.Close()
+			t.Fatalf("listening on %s was allowed", _address)
+		}
+	}
+}
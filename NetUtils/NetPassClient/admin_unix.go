@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// -------------------------
+import (
+	"net"
+	"syscall"
+)
+
+// -------------------------
+// listenUnix 以 umask 0177 建立 Unix Socket，建立時權限即為 0600，不會有其他使用者可以連線的空窗
+// umask 是整個進程共用的設定，只在建立 Socket 的瞬間變更
+func listenUnix(path string) (net.Listener, error) {
+	_umask := syscall.Umask(0177)
+	defer syscall.Umask(_umask)
+	return net.Listen("unix", path)
+}
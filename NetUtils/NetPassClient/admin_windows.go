@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+// -------------------------
+import (
+	"net"
+)
+
+// -------------------------
+// listenUnix 建立 Unix Socket，Windows 上的存取權限由所在目錄的 ACL 決定
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,296 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// -------------------------
+const authModeAPIKey = "api_key"
+const authModeKeypair = "keypair"
+
+// Token 未帶有效期限時的預設值，以及到期前多久更新
+const defaultTokenLifetime = time.Hour
+const tokenRefreshMargin = time.Minute
+
+// -------------------------
+// errKeyNotRegistered 表示伺服器尚未登記此裝置的公鑰
+var errKeyNotRegistered = errors.New("public key is not registered")
+
+// -------------------------
+// authResponse 是金鑰模式下 /api/getID 的回應
+type authResponse struct {
+	ID        string `json:"id"`         // 分配的連線 ID
+	Token     string `json:"token"`      // 短效 Token，作為 MQTT 密碼與 WSS 隧道的 Bearer Token
+	ExpiresIn int64  `json:"expires_in"` // Token 有效秒數
+}
+
+// -------------------------
+// MQTTConfig 定義登入 MQTT Broker 的帳號密碼，供自架 Broker 依帳號限制每個裝置只能存取自己的 Topic
+// auth_mode 為 keypair 時改以分配的 ID 與短效 Token 登入，不使用這裡的密碼
+type MQTTConfig struct {
+	Username     string `json:"username"`      // 帳號，未設定時使用分配的 ID
+	Password     string `json:"password"`      // 密碼
+	PasswordFile string `json:"password_file"` // 密碼檔，每次連線與重新連線時重新讀取，可由外部程式定期更新 Token
+}
+
+// -------------------------
+// Validate 檢查帳密設定
+func (_this *MQTTConfig) Validate() error {
+	if _this == nil {
+		return nil
+	}
+	if _this.Password != "" && _this.PasswordFile != "" {
+		return errors.New("mqtt.password: password and password_file cannot be used together")
+	}
+	if _this.PasswordFile != "" {
+		if _, err := os.Stat(_this.PasswordFile); err != nil {
+			return fmt.Errorf("mqtt.password_file: %v", err)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// authMode 回傳 profile 的認證方式，預設為 api_key
+func (_this *ProfileConfig) authMode() string {
+	if strings.EqualFold(strings.TrimSpace(_this.AuthMode), authModeKeypair) {
+		return authModeKeypair
+	}
+	return authModeAPIKey
+}
+
+// -------------------------
+// signChallenge 以裝置私鑰簽署伺服器發出的 Challenge
+// 簽署內容包含用途、本機 ID 與 Challenge，避免簽章被挪用到其他請求
+func signChallenge(key ed25519.PrivateKey, purpose string, localHWID string, nonce string) string {
+	_message := purpose + "\n" + localHWID + "\n" + nonce
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(_message)))
+}
+
+// -------------------------
+// authClient 建立向伺服器認證用的 HTTP Client
+func (_this *Profile) authClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: _this.serverTLSConfig(),
+		},
+	}
+}
+
+// -------------------------
+// postForm 送出表單並回傳 200 的回應內容，其他狀態碼轉為錯誤
+func (_this *Profile) postForm(client *http.Client, path string, form url.Values) ([]byte, int, error) {
+	_url := fmt.Sprintf("%s%s", strings.TrimSuffix(_this.settings().Host, "/"), path)
+	_resp, err := client.Post(_url, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer _resp.Body.Close()
+
+	_body, err := io.ReadAll(_resp.Body)
+	if err != nil {
+		return nil, _resp.StatusCode, err
+	}
+	if _resp.StatusCode != http.StatusOK {
+		_msg := strings.TrimSpace(string(_body))
+		if _msg == "" {
+			_msg = http.StatusText(_resp.StatusCode)
+		}
+		return nil, _resp.StatusCode, fmt.Errorf("%s returned %d: %s", path, _resp.StatusCode, _msg)
+	}
+	return _body, _resp.StatusCode, nil
+}
+
+// -------------------------
+// challenge 向伺服器索取一次性的 Challenge
+func (_this *Profile) challenge(client *http.Client, localHWID string) (string, error) {
+	_body, _, err := _this.postForm(client, "/api/challenge", url.Values{"hwid": {localHWID}})
+	if err != nil {
+		return "", err
+	}
+	_nonce := strings.TrimSpace(string(_body))
+	if _nonce == "" {
+		return "", errors.New("server returned an empty challenge")
+	}
+	return _nonce, nil
+}
+
+// -------------------------
+// registerKey 以 API Key 向伺服器登記裝置公鑰，只在伺服器尚未登記時執行一次
+// 同時簽署 Challenge 證明持有對應的私鑰
+func (_this *Profile) registerKey(client *http.Client, key ed25519.PrivateKey, localHWID string) error {
+	_apiKey := _this.settings().ApiKey
+	if _apiKey == "" {
+		return errors.New("api_key is required to register the device public key")
+	}
+	_nonce, err := _this.challenge(client, localHWID)
+	if err != nil {
+		return err
+	}
+
+	_form := url.Values{}
+	_form.Set("hwid", localHWID)
+	_form.Set("key", _apiKey)
+	_form.Set("public_key", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	_form.Set("nonce", _nonce)
+	_form.Set("signature", signChallenge(key, "register", localHWID, _nonce))
+
+	_, _, err = _this.postForm(client, "/api/registerKey", _form)
+	return err
+}
+
+// -------------------------
+// requestToken 以簽署的 Challenge 向 /api/getID 領取分配的 ID 與短效 Token
+func (_this *Profile) requestToken(client *http.Client, key ed25519.PrivateKey, localHWID string) (authResponse, error) {
+	var _auth authResponse
+	_nonce, err := _this.challenge(client, localHWID)
+	if err != nil {
+		return _auth, err
+	}
+
+	_form := url.Values{}
+	_form.Set("hwid", localHWID)
+	_form.Set("public_key", base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+	_form.Set("nonce", _nonce)
+	_form.Set("signature", signChallenge(key, "getid", localHWID, _nonce))
+	if _name := strings.TrimSpace(_this.settings().Name); _name != "" {
+		_form.Set("name", _name)
+	}
+
+	_body, _status, err := _this.postForm(client, "/api/getID", _form)
+	if _status == http.StatusUnauthorized {
+		return _auth, errKeyNotRegistered
+	}
+	if err != nil {
+		return _auth, err
+	}
+	if err := json.Unmarshal(_body, &_auth); err != nil {
+		return _auth, fmt.Errorf("invalid /api/getID response: %v", err)
+	}
+	if _auth.ID == "" || _auth.Token == "" {
+		return _auth, errors.New("server returned no id or token")
+	}
+	return _auth, nil
+}
+
+// -------------------------
+// authenticate 以裝置金鑰認證，伺服器尚未登記公鑰時先以 API Key 登記後重試
+// 成功時保存 Token 並回傳分配的 ID
+func (_this *Profile) authenticate(localHWID string) (string, error) {
+	_key, err := deviceKey()
+	if err != nil {
+		return "", err
+	}
+	_client := _this.authClient()
+
+	_auth, err := _this.requestToken(_client, _key, localHWID)
+	if errors.Is(err, errKeyNotRegistered) {
+		_this.log().Infof("Registering device public key with %s...", _this.settings().Host)
+		if err := _this.registerKey(_client, _key, localHWID); err != nil {
+			return "", fmt.Errorf("public key registration failed: %w", err)
+		}
+		_auth, err = _this.requestToken(_client, _key, localHWID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_lifetime := time.Duration(_auth.ExpiresIn) * time.Second
+	if _lifetime <= 0 {
+		_lifetime = defaultTokenLifetime
+	}
+	_this.lock.Lock()
+	_this.token = _auth.Token
+	_this.tokenExpires = time.Now().Add(_lifetime)
+	_this.lock.Unlock()
+
+	return strings.TrimSpace(_auth.ID), nil
+}
+
+// -------------------------
+// authToken 回傳目前有效的 Token，即將到期時重新認證
+func (_this *Profile) authToken() (string, error) {
+	_this.lock.RLock()
+	_token, _expires := _this.token, _this.tokenExpires
+	_this.lock.RUnlock()
+
+	if _token != "" && time.Until(_expires) > tokenRefreshMargin {
+		return _token, nil
+	}
+
+	_hardwareID := getHardwareID()
+	if _hardwareID == "" {
+		return "", errors.New("no device identity")
+	}
+	if _, err := _this.authenticate(_this.localHWID(_hardwareID)); err != nil {
+		return "", err
+	}
+
+	_this.lock.RLock()
+	defer _this.lock.RUnlock()
+	return _this.token, nil
+}
+
+// -------------------------
+// hasMQTTCredentials 回傳連線 Broker 時是否需要帳密
+func (_this *ProfileConfig) hasMQTTCredentials() bool {
+	return _this.authMode() == authModeKeypair || _this.MQTT != nil
+}
+
+// -------------------------
+// mqttCredentials 是 MQTT 連線與重新連線時呼叫的帳密來源
+// 金鑰模式以分配的 ID 為帳號、短效 Token 為密碼；否則使用 mqtt 設定的帳號與密碼 (或密碼檔)
+func (_this *Profile) mqttCredentials() (string, string) {
+	_config := _this.settings()
+	if _config.authMode() == authModeKeypair {
+		_token, err := _this.authToken()
+		if err != nil {
+			_this.log().Errorf("Failed to refresh MQTT token: %v", err)
+		}
+		return _this.assignedID(), _token
+	}
+
+	_mqtt := _config.MQTT
+	if _mqtt == nil {
+		return "", ""
+	}
+	_username := _mqtt.Username
+	if _username == "" {
+		_username = _this.assignedID()
+	}
+	_password := _mqtt.Password
+	if _mqtt.PasswordFile != "" {
+		_data, err := os.ReadFile(_mqtt.PasswordFile)
+		if err != nil {
+			_this.log().Errorf("Failed to read MQTT password file: %v", err)
+		}
+		_password = strings.TrimSpace(string(_data))
+	}
+	return _username, _password
+}
+
+// -------------------------
+// tunnelHeader 回傳連線 WSS 隧道時附帶的認證 Header
+func (_this *Profile) tunnelHeader() http.Header {
+	if _this.settings().authMode() != authModeKeypair {
+		return nil
+	}
+	_token, err := _this.authToken()
+	if err != nil {
+		_this.log().Errorf("Failed to refresh tunnel token: %v", err)
+		return nil
+	}
+	return http.Header{"Authorization": {"Bearer " + _token}}
+}
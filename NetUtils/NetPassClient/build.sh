@@ -18,6 +18,13 @@ PLATFORMS=(
     "windows/amd64/.exe"
 )
 
+# 自動更新驗證用的 ed25519 公鑰 (Base64)，沒有公鑰的 Client 無法自動更新，因此必須提供
+if [ -z "$UPDATE_PUBLIC_KEY" ]; then
+    echo "❌ 未設定 UPDATE_PUBLIC_KEY，請以 UPDATE_PUBLIC_KEY=<base64> ./build.sh 編譯"
+    exit 1
+fi
+LDFLAGS="-X main.updatePublicKey=$UPDATE_PUBLIC_KEY"
+
 # 獲取 Go 的完整路徑
 GO_BIN=$(which go)
 if [ -z "$GO_BIN" ]; then
@@ -50,9 +57,9 @@ for PLATFORM in "${PLATFORMS[@]}"; do
     
     # 執行編譯 (加上 -ldflags 以隱藏 Windows 的命令提示字元視窗)
     if [ "$OS" == "windows" ]; then
-        env GOOS=$OS GOARCH=$ARCH go build -ldflags="-H windowsgui" -o "$OUTPUT_DIR/$OUTPUT_NAME" .
+        env GOOS=$OS GOARCH=$ARCH go build -ldflags="-H windowsgui $LDFLAGS" -o "$OUTPUT_DIR/$OUTPUT_NAME" .
     else
-        env GOOS=$OS GOARCH=$ARCH go build -o "$OUTPUT_DIR/$OUTPUT_NAME" .
+        env GOOS=$OS GOARCH=$ARCH go build -ldflags="$LDFLAGS" -o "$OUTPUT_DIR/$OUTPUT_NAME" .
     fi
     
     if [ $? -eq 0 ]; then
@@ -0,0 +1,356 @@
+package main
+
+// -------------------------
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// -------------------------
+// cliOptions 是命令列的子命令與參數
+type cliOptions struct {
+	command []string // 子命令，例如 run、status、config validate
+	config  string   // 設定檔路徑
+	host    string   // 覆寫 host
+	name    string   // 覆寫 name
+	apiKey  string   // 覆寫 api_key
+	daemon  bool     // 背景模式的子進程
+	json    bool     // 以 JSON 輸出
+	print   bool     // install-service 只輸出服務定義
+}
+
+// -------------------------
+var cli cliOptions
+
+// -------------------------
+const cliUsage = `Usage: NetPassClient [command] [flags]
+
+Commands:
+  run                 Connect and serve requests (default)
+  status              Show the state of the running instance
+  stop                Ask the running instance to drain and exit
+  id                  Print the assigned ID and public URLs of every profile
+  check-update        Check the update server for a newer version
+  identity show       Print the persisted device identity
+  identity export     Print the identity file, to move the device ID to new hardware
+  identity reset      Replace the device identity with a new random ID
+  config validate     Check the configuration and report every problem
+  install-service     Install and start this instance as a system service
+  uninstall-service   Stop and remove the system service of this instance
+
+Flags:
+`
+
+// -------------------------
+// parseCLI 解析子命令與參數，參數可放在子命令前後 (例如 NetPassClient --config a.json status)
+func parseCLI(args []string) (cliOptions, error) {
+	var _opts cliOptions
+	_flags := newFlagSet(&_opts, io.Discard)
+
+	for {
+		if err := _flags.Parse(args); err != nil {
+			return _opts, err
+		}
+		args = _flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		_opts.command = append(_opts.command, args[0])
+		args = args[1:]
+	}
+
+	if len(_opts.command) == 0 {
+		_opts.command = []string{"run"}
+	}
+	return _opts, nil
+}
+
+// -------------------------
+func newFlagSet(opts *cliOptions, output io.Writer) *flag.FlagSet {
+	_flags := flag.NewFlagSet(defaultAppName, flag.ContinueOnError)
+	_flags.SetOutput(output)
+	_flags.StringVar(&opts.config, "config", "", "path to config.json")
+	_flags.StringVar(&opts.host, "host", "", "override host")
+	_flags.StringVar(&opts.name, "name", "", "override device name")
+	_flags.StringVar(&opts.apiKey, "api-key", "", "override api_key")
+	_flags.BoolVar(&opts.daemon, "d", false, "run in background (internal, set on the forked child)")
+	_flags.BoolVar(&opts.json, "json", false, "print status, id and identity as JSON")
+	_flags.BoolVar(&opts.print, "print", false, "install-service: print the service definition instead of installing it")
+	return _flags
+}
+
+// -------------------------
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, cliUsage)
+	newFlagSet(&cliOptions{}, w).PrintDefaults()
+}
+
+// -------------------------
+// applyOverrides 以命令列參數覆寫設定檔的值
+func (_this *cliOptions) applyOverrides(config *Config) {
+	if _this.host != "" {
+		config.Host = _this.host
+	}
+	if _this.name != "" {
+		config.Name = _this.name
+	}
+	if _this.apiKey != "" {
+		config.ApiKey = _this.apiKey
+	}
+}
+
+// -------------------------
+// runCommand 執行子命令並回傳結束代碼，run 不會返回
+func runCommand(opts cliOptions) int {
+	locateConfig()
+
+	switch strings.Join(opts.command, " ") {
+	case "run":
+		runClient()
+		return 0
+	case "help":
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	// 其他子命令只輸出結果，日誌改到 stderr 並只顯示警告
+	initCLILogging()
+	if strings.Join(opts.command, " ") == "config validate" {
+		return cmdValidateConfig()
+	}
+	if err := loadConfig(); err != nil {
+		logConfigError(err)
+		return 1
+	}
+
+	switch strings.Join(opts.command, " ") {
+	case "status":
+		return cmdStatus(opts)
+	case "stop":
+		return cmdStop()
+	case "id":
+		return cmdID(opts)
+	case "check-update":
+		return cmdCheckUpdate()
+	case "install-service":
+		return cmdInstallService(opts)
+	case "uninstall-service":
+		return cmdUninstallService()
+	case "identity", "identity show":
+		return cmdIdentity(opts, "show")
+	case "identity export", "identity reset":
+		return cmdIdentity(opts, opts.command[1])
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(opts.command, " "))
+	printUsage(os.Stderr)
+	return 2
+}
+
+// -------------------------
+// runningInstance 回傳目前設定對應的執行中實例
+func runningInstance() (InstanceInfo, bool) {
+	_name := currentConfig().instanceName()
+	if !instanceRunning(_name) {
+		return InstanceInfo{Instance: _name}, false
+	}
+	_info, _ := readInstanceInfo(_name)
+	return _info, true
+}
+
+// -------------------------
+// fetchAdminStatus 透過管理 API 取得執行中實例的狀態
+func fetchAdminStatus(info InstanceInfo) (map[string]any, error) {
+	if info.Admin == "" {
+		return nil, errors.New("admin.listen is not configured")
+	}
+	_client, _base := adminClient(info.Admin)
+	_resp, err := _client.Get(_base + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer _resp.Body.Close()
+	if _resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/status returned %d", _resp.StatusCode)
+	}
+
+	var _status map[string]any
+	if err := json.NewDecoder(_resp.Body).Decode(&_status); err != nil {
+		return nil, err
+	}
+	return _status, nil
+}
+
+// -------------------------
+// cmdStatus 顯示執行中實例的狀態，未執行時結束代碼為 3
+func cmdStatus(opts cliOptions) int {
+	_info, ok := runningInstance()
+	if !ok {
+		fmt.Printf("Instance %q is not running.\n", _info.Instance)
+		return 3
+	}
+
+	_status, err := fetchAdminStatus(_info)
+	if err != nil {
+		// 沒有管理 API 時只能顯示鎖定檔中的資訊
+		_status = map[string]any{
+			"instance": _info.Instance,
+			"pid":      _info.PID,
+			"config":   _info.Config,
+			"started":  time.Unix(_info.Started, 0).Format(time.RFC3339),
+			"note":     "detailed status unavailable: " + err.Error(),
+		}
+	}
+
+	_data, _ := json.MarshalIndent(_status, "", "  ")
+	fmt.Println(string(_data))
+	return 0
+}
+
+// -------------------------
+// cmdStop 請執行中的實例排空連線後結束
+func cmdStop() int {
+	_info, ok := runningInstance()
+	if !ok {
+		fmt.Printf("Instance %q is not running.\n", _info.Instance)
+		return 0
+	}
+
+	fmt.Printf("Stopping instance %q (PID %d)...\n", _info.Instance, _info.PID)
+	if err := stopInstance(_info.Instance); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Stopped.")
+	return 0
+}
+
+// -------------------------
+// profileIdentity 是 id 子命令輸出的一筆 profile 資訊
+type profileIdentity struct {
+	Profile   string `json:"profile"`
+	ID        string `json:"id"`
+	PublicURL string `json:"public_url"`
+	WSSURL    string `json:"wss_url"`
+}
+
+// -------------------------
+// cmdID 輸出各 profile 分配的 ID 與公網網址
+// 實例執行中時向管理 API 查詢，否則直接向伺服器領取 (與啟動時相同的 ID)
+func cmdID(opts cliOptions) int {
+	var _list []profileIdentity
+
+	if _info, ok := runningInstance(); ok {
+		if _status, err := fetchAdminStatus(_info); err == nil {
+			_profiles, _ := _status["profiles"].([]any)
+			for _, _p := range _profiles {
+				_m, _ := _p.(map[string]any)
+				_id, _ := _m["id"].(string)
+				_hwID, _ := _m["hw_id"].(string)
+				_url, _ := _m["public_url"].(string)
+				_list = append(_list, profileIdentity{Profile: _id, ID: _hwID, PublicURL: _url})
+			}
+		}
+	}
+
+	if _list == nil {
+		_hardwareID := getHardwareID()
+		if _hardwareID == "" {
+			fmt.Fprintln(os.Stderr, "Failed to generate local hardware ID.")
+			return 1
+		}
+		for _, _p := range runningProfiles() {
+			_p.setAssignedID(_p.getAssignedID(_p.localHWID(_hardwareID)))
+			_list = append(_list, profileIdentity{Profile: _p.settings().ID, ID: _p.assignedID(), PublicURL: _p.publicURL()})
+		}
+	}
+
+	// 未領取到 ID 的 profile 沒有可用的網址，結束代碼為 1
+	_code := 0
+	for i := range _list {
+		if _list[i].ID == "" {
+			_list[i].PublicURL = ""
+			_code = 1
+			continue
+		}
+		_list[i].WSSURL = strings.Replace(_list[i].PublicURL, "https://", "wss://", 1)
+	}
+
+	if opts.json {
+		_data, _ := json.MarshalIndent(_list, "", "  ")
+		fmt.Println(string(_data))
+		return _code
+	}
+
+	_out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(_out, "PROFILE\tID\tPUBLIC URL\tWSS URL")
+	for _, _p := range _list {
+		fmt.Fprintf(_out, "%s\t%s\t%s\t%s\n", _p.Profile, _p.ID, _p.PublicURL, _p.WSSURL)
+	}
+	_out.Flush()
+	return _code
+}
+
+// -------------------------
+// cmdCheckUpdate 查詢更新伺服器並顯示是否有新版本，不會安裝
+func cmdCheckUpdate() int {
+	_manifest, err := fetchManifest(updateClient())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Update check failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Current version: %s\n", defaultVersion)
+	fmt.Printf("Latest version:  %s (%s channel)\n", _manifest.Version, currentConfig().updateChannel())
+
+	if _publicKey, err := getUpdatePublicKey(); err != nil {
+		fmt.Printf("Signature:       not checked (%v)\n", err)
+	} else if err := _manifest.verify(_publicKey); err != nil {
+		fmt.Printf("Signature:       INVALID (%v)\n", err)
+		return 1
+	} else {
+		fmt.Println("Signature:       valid")
+	}
+
+	if compareVersions(_manifest.Version, defaultVersion) > 0 {
+		fmt.Println("An update is available.")
+	} else {
+		fmt.Println("Already up to date.")
+	}
+	return 0
+}
+
+// -------------------------
+// cmdValidateConfig 檢查設定檔、環境變數與命令列參數並列出所有問題
+func cmdValidateConfig() int {
+	_source := configPath
+	if _, err := os.Stat(configPath); err != nil && !configExplicit {
+		_source = "defaults and environment (no config file found)"
+	}
+
+	_, err := readConfig()
+	if err == nil {
+		fmt.Printf("%s is valid.\n", _source)
+		return 0
+	}
+
+	var _problems configErrors
+	if !errors.As(err, &_problems) {
+		fmt.Printf("%s: %v\n", _source, err)
+		return 1
+	}
+
+	fmt.Printf("%s has %d problem(s):\n", _source, len(_problems))
+	for _, _p := range _problems {
+		fmt.Printf("  - %s\n", _p)
+	}
+	return 1
+}
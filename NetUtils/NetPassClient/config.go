@@ -0,0 +1,474 @@
+package main
+
+// -------------------------
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// -------------------------
+// 環境變數前綴，例如 NETPASS_HOST、NETPASS_LOG_LEVEL
+const envPrefix = "NETPASS"
+
+// 依序搜尋的設定檔名稱
+var configFileNames = []string{"config.json", "config.yaml", "config.yml", "config.toml"}
+
+// -------------------------
+// configExplicit 表示設定檔路徑由 -config 或 NETPASS_CONFIG 指定，找不到檔案時視為錯誤
+var configExplicit bool
+
+// -------------------------
+// configProblem 是一項設定錯誤，Field 為設定檔中的欄位路徑 (例如 profiles[0].ports.allow)
+type configProblem struct {
+	Field   string
+	Message string
+}
+
+// -------------------------
+func (_this configProblem) String() string {
+	if _this.Field == "" {
+		return _this.Message
+	}
+	return _this.Field + ": " + _this.Message
+}
+
+// -------------------------
+// configErrors 收集所有設定錯誤，一次回報而不是遇到第一個就停止
+type configErrors []configProblem
+
+// -------------------------
+func (_this configErrors) Error() string {
+	_list := make([]string, len(_this))
+	for i, _p := range _this {
+		_list[i] = _p.String()
+	}
+	return strings.Join(_list, "; ")
+}
+
+// -------------------------
+// add 記錄欄位的一項錯誤
+func (_this *configErrors) add(field string, err error) {
+	if err == nil {
+		return
+	}
+	*_this = append(*_this, configProblem{Field: field, Message: err.Error()})
+}
+
+// -------------------------
+// addNested 記錄已以欄位名稱開頭的錯誤 (例如 "ports.allow: invalid port 0")，並在欄位前補上 prefix
+func (_this *configErrors) addNested(prefix string, err error) {
+	if err == nil {
+		return
+	}
+	_message := err.Error()
+	if _field, _rest, ok := strings.Cut(_message, ": "); ok && !strings.Contains(_field, " ") {
+		*_this = append(*_this, configProblem{Field: joinField(prefix, _field), Message: _rest})
+		return
+	}
+	*_this = append(*_this, configProblem{Field: prefix, Message: _message})
+}
+
+// -------------------------
+func joinField(prefix string, field string) string {
+	if prefix == "" {
+		return field
+	}
+	return prefix + "." + field
+}
+
+// -------------------------
+// systemConfigDir 回傳系統層級的設定目錄
+func systemConfigDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("ProgramData"), defaultAppName)
+	case "darwin":
+		return filepath.Join("/Library/Application Support", defaultAppName)
+	default:
+		return "/etc/netpass"
+	}
+}
+
+// -------------------------
+// configSearchPaths 回傳設定檔的搜尋順序：工作目錄、使用者設定目錄、系統設定目錄
+func configSearchPaths() []string {
+	_dirs := []string{"."}
+	if _dir, err := os.UserConfigDir(); err == nil {
+		_dirs = append(_dirs, filepath.Join(_dir, defaultAppName))
+	}
+	_dirs = append(_dirs, systemConfigDir())
+
+	var _paths []string
+	for _, _dir := range _dirs {
+		for _, _name := range configFileNames {
+			_paths = append(_paths, filepath.Join(_dir, _name))
+		}
+	}
+	return _paths
+}
+
+// -------------------------
+// locateConfig 決定設定檔路徑：-config 參數、NETPASS_CONFIG，最後依序搜尋標準位置
+// 都找不到時沿用工作目錄下的 config.json，只以預設值與環境變數執行
+func locateConfig() {
+	if cli.config != "" {
+		configPath = cli.config
+		configExplicit = true
+		return
+	}
+	if _path := os.Getenv(envPrefix + "_CONFIG"); _path != "" {
+		configPath = _path
+		configExplicit = true
+		return
+	}
+	for _, _path := range configSearchPaths() {
+		if _info, err := os.Stat(_path); err == nil && !_info.IsDir() {
+			configPath = _path
+			return
+		}
+	}
+}
+
+// -------------------------
+// loadConfig 載入設定，設定有誤時回傳錯誤而不套用
+func loadConfig() error {
+	_config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	applyConfig(_config)
+	return nil
+}
+
+// -------------------------
+// logConfigError 逐行記錄設定錯誤
+func logConfigError(err error) {
+	var _problems configErrors
+	if !errors.As(err, &_problems) {
+		logErrorf("Invalid configuration in %s: %v", configPath, err)
+		return
+	}
+	for _, _p := range _problems {
+		logErrorf("Invalid configuration in %s: %s", configPath, _p)
+	}
+}
+
+// -------------------------
+// readConfig 依序套用設定檔、環境變數與命令列參數並檢查所有欄位，不會修改目前使用中的設定
+func readConfig() (Config, error) {
+	_config, err := decodeConfigFile(configPath)
+	if err != nil {
+		return _config, err
+	}
+
+	_problems := applyEnvOverrides(&_config)
+
+	// 命令列參數優先於設定檔與環境變數
+	cli.applyOverrides(&_config)
+
+	// 設定預設值
+	if _config.Host == "" {
+		_config.Host = defaultHost
+	}
+
+	if _problems = append(_problems, _config.validate()...); len(_problems) > 0 {
+		return _config, _problems
+	}
+
+	// 補齊各 profile 的設定
+	resolveProfiles(&_config)
+
+	return _config, nil
+}
+
+// -------------------------
+// applyConfig 套用設定並建立或更新各 profile
+func applyConfig(config Config) {
+	Global.config.Store(&config)
+	applyWorkers(config.Workers)
+	applyProfiles(config.Profiles)
+}
+
+// -------------------------
+// decodeConfigFile 依副檔名讀取 JSON、YAML 或 TOML 設定檔，不認得的欄位視為錯誤
+// YAML 與 TOML 先轉為 JSON，欄位名稱與 config.json 相同
+func decodeConfigFile(path string) (Config, error) {
+	var _config Config
+
+	_data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !configExplicit {
+		return _config, nil
+	}
+	if err != nil {
+		return _config, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var _value any
+		if err := yaml.Unmarshal(_data, &_value); err != nil {
+			return _config, err
+		}
+		if _data, err = json.Marshal(_value); err != nil {
+			return _config, err
+		}
+	case ".toml":
+		var _value map[string]any
+		if _, err := toml.Decode(string(_data), &_value); err != nil {
+			return _config, err
+		}
+		if _data, err = json.Marshal(_value); err != nil {
+			return _config, err
+		}
+	}
+
+	_decoder := json.NewDecoder(bytes.NewReader(_data))
+	_decoder.DisallowUnknownFields()
+	if err := _decoder.Decode(&_config); err != nil {
+		return _config, decodeError(err)
+	}
+	return _config, nil
+}
+
+// -------------------------
+// decodeError 將解析錯誤轉為帶欄位名稱的訊息
+func decodeError(err error) error {
+	var _typeErr *json.UnmarshalTypeError
+	var _syntaxErr *json.SyntaxError
+
+	switch {
+	case errors.As(err, &_typeErr):
+		return configErrors{{Field: _typeErr.Field, Message: fmt.Sprintf("expected %s, got %s", _typeErr.Type, _typeErr.Value)}}
+	case errors.As(err, &_syntaxErr):
+		return fmt.Errorf("syntax error at byte %d: %v", _syntaxErr.Offset, err)
+	}
+
+	if _field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		_field, _ = strconv.Unquote(_field)
+		return configErrors{{Field: _field, Message: "unknown field"}}
+	}
+	return err
+}
+
+// -------------------------
+// applyEnvOverrides 以環境變數覆寫設定，名稱為 NETPASS_ 加上大寫的欄位路徑
+// 例如 NETPASS_API_KEY、NETPASS_LOG_LEVEL、NETPASS_TLS_CA_FILE；清單以逗號分隔，其餘複合欄位 (例如 NETPASS_PORTS) 以 JSON 指定
+func applyEnvOverrides(config *Config) configErrors {
+	var _problems configErrors
+	applyEnv(reflect.ValueOf(config).Elem(), envPrefix, "", &_problems)
+
+	// 舊版的環境變數
+	if config.ApiKey == "" {
+		config.ApiKey = os.Getenv("NETPASS_KEY")
+	}
+	return _problems
+}
+
+// -------------------------
+// applyEnv 逐一檢查結構欄位對應的環境變數，回傳是否有任何欄位被覆寫
+func applyEnv(value reflect.Value, prefix string, path string, problems *configErrors) bool {
+	_set := false
+	_type := value.Type()
+
+	for i := 0; i < _type.NumField(); i++ {
+		_tag, _, _ := strings.Cut(_type.Field(i).Tag.Get("json"), ",")
+		if _tag == "" || _tag == "-" {
+			continue
+		}
+		_name := prefix + "_" + strings.ToUpper(_tag)
+		_field := value.Field(i)
+
+		if _env, ok := os.LookupEnv(_name); ok {
+			if err := setFromEnv(_field, _env); err != nil {
+				problems.add(joinField(path, _tag), fmt.Errorf("%s: %v", _name, err))
+			}
+			_set = true
+			continue
+		}
+
+		// 結構欄位逐層展開，只有子欄位被設定時才建立指標欄位
+		switch {
+		case _field.Kind() == reflect.Struct:
+			_set = applyEnv(_field, _name, joinField(path, _tag), problems) || _set
+		case _field.Kind() == reflect.Pointer && _field.Type().Elem().Kind() == reflect.Struct:
+			_new := reflect.New(_field.Type().Elem())
+			if !_field.IsNil() {
+				_new.Elem().Set(_field.Elem())
+			}
+			if applyEnv(_new.Elem(), _name, joinField(path, _tag), problems) {
+				_field.Set(_new)
+				_set = true
+			}
+		}
+	}
+	return _set
+}
+
+// -------------------------
+// setFromEnv 將環境變數的字串值寫入欄位
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		_b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(_b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_n, err := strconv.ParseInt(strings.TrimSpace(value), 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(_n)
+	case reflect.Slice:
+		_elem := field.Type().Elem().Kind()
+		_value := strings.TrimSpace(value)
+		if (_elem == reflect.String || _elem == reflect.Int) && !strings.HasPrefix(_value, "[") {
+			_items := strings.Split(_value, ",")
+			_slice := reflect.MakeSlice(field.Type(), len(_items), len(_items))
+			for i, _item := range _items {
+				if err := setFromEnv(_slice.Index(i), strings.TrimSpace(_item)); err != nil {
+					return err
+				}
+			}
+			field.Set(_slice)
+			return nil
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// validate 檢查所有欄位並回傳每一項錯誤
+func (_this *Config) validate() configErrors {
+	var _problems configErrors
+
+	validateIdentity(&_problems, "", _this.Host, _this.Name)
+	_problems.add("auth_mode", validateChoice(_this.AuthMode, authModeAPIKey, authModeKeypair))
+	_problems.addNested("", _this.MQTT.Validate())
+	_problems.addNested("", _this.Timeouts.Validate())
+	_problems.addNested("", _this.Workers.Validate())
+	_problems.addNested("", _this.LocalHTTP.Validate())
+	_problems.addNested("", _this.Ports.Validate())
+	_problems.addNested("", validateTargets(_this.Targets))
+	_, err := buildServerTLSConfig(_this.TLS)
+	_problems.addNested("", err)
+
+	_problems.add("update_interval", validateDuration(_this.UpdateInterval))
+	_problems.add("update_channel", validateChoice(_this.UpdateChannel, "stable", "beta"))
+	if _key := strings.TrimSpace(_this.UpdatePublicKey); _key != "" {
+		if _data, err := base64.StdEncoding.DecodeString(_key); err != nil || len(_data) != ed25519.PublicKeySize {
+			_problems.add("update_public_key", errors.New("must be a base64 ed25519 public key"))
+		}
+	}
+	_problems.add("shutdown_grace", validateDuration(_this.ShutdownGrace))
+	_problems.add("on_conflict", validateChoice(_this.OnConflict, conflictReplace, conflictRefuse))
+	_problems.add("log.level", validateChoice(_this.Log.Level, "debug", "info", "warn", "warning", "error"))
+	_problems.add("log.format", validateChoice(_this.Log.Format, "text", "json"))
+
+	_numbers := []struct {
+		field string
+		value int64
+	}{
+		{"stream_threshold", _this.StreamThreshold},
+		{"stream_chunk_size", int64(_this.StreamChunkSize)},
+		{"log.max_size_mb", int64(_this.Log.MaxSizeMB)},
+		{"log.max_age_days", int64(_this.Log.MaxAgeDays)},
+		{"log.max_backups", int64(_this.Log.MaxBackups)},
+	}
+	for _, _n := range _numbers {
+		if _n.value < 0 {
+			_problems.add(_n.field, errors.New("must not be negative"))
+		}
+	}
+
+	_ids := map[string]bool{}
+	for i, _p := range _this.Profiles {
+		_prefix := fmt.Sprintf("profiles[%d]", i)
+		_id := strings.TrimSpace(_p.ID)
+		if _id != "" && _ids[_id] {
+			_problems.add(_prefix+".id", fmt.Errorf("duplicate id %q", _id))
+		}
+		_ids[_id] = true
+
+		validateIdentity(&_problems, _prefix, _p.Host, _p.Name)
+		_problems.add(_prefix+".auth_mode", validateChoice(_p.AuthMode, authModeAPIKey, authModeKeypair))
+		_problems.addNested(_prefix, _p.MQTT.Validate())
+		_problems.addNested(_prefix, _p.Ports.Validate())
+		_problems.addNested(_prefix, validateTargets(_p.Targets))
+		_, err := buildServerTLSConfig(_p.TLS)
+		_problems.addNested(_prefix, err)
+	}
+
+	return _problems
+}
+
+// -------------------------
+// validateIdentity 檢查伺服器網址與裝置名稱
+func validateIdentity(problems *configErrors, prefix string, host string, name string) {
+	if host != "" {
+		_url, err := url.Parse(host)
+		if err != nil || (_url.Scheme != "http" && _url.Scheme != "https") || _url.Host == "" {
+			problems.add(joinField(prefix, "host"), fmt.Errorf("%q is not an http(s) URL", host))
+		}
+	}
+	// 只檢查長度 (與舊版相同)，允許的字元由伺服器決定，避免升級後既有的名稱無法啟動
+	if _name := strings.TrimSpace(name); _name != "" {
+		if _length := utf8.RuneCountInString(_name); _length < 3 || _length > 64 {
+			problems.add(joinField(prefix, "name"), fmt.Errorf("%q must be 3-64 characters", name))
+		}
+	}
+}
+
+// -------------------------
+func validateDuration(value string) error {
+	if value == "" {
+		return nil
+	}
+	_d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	if _d < 0 {
+		return errors.New("must not be negative")
+	}
+	return nil
+}
+
+// -------------------------
+func validateChoice(value string, choices ...string) error {
+	_value := strings.ToLower(strings.TrimSpace(value))
+	if _value == "" {
+		return nil
+	}
+	for _, _c := range choices {
+		if _value == _c {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+}
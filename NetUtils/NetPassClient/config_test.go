@@ -0,0 +1,91 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// -------------------------
+func TestConfigValidate(t *testing.T) {
+	_publicKey := base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))
+
+	_tests := []struct {
+		name   string
+		config Config
+		want   []string
+	}{
+		{"empty", Config{}, nil},
+		{"valid", Config{
+			Host:            "https://netpass.example.com",
+			Name:            "測試機",
+			AuthMode:        "KeyPair",
+			UpdatePublicKey: _publicKey,
+			UpdateInterval:  "6h",
+			UpdateChannel:   "beta",
+			ShutdownGrace:   "0",
+			OnConflict:      "refuse",
+			Log:             LogConfig{Level: "warn", Format: "json"},
+			Timeouts:        &TimeoutConfig{Connect: "5s", Ports: map[string]PortTimeouts{"8080": {Total: "0"}}},
+			Workers:         &WorkerConfig{HTTP: &PoolConfig{Concurrency: 1}, QueueTimeout: "1m"},
+			LocalHTTP:       &LocalHTTPConfig{H2CPorts: []string{"50051"}, HTTPSPorts: []string{"8443"}},
+			Ports:           &PortPolicy{Allow: []PortRule{{Port: 22, Types: []string{"tcp"}}}, Deny: []int{3306}},
+			Targets:         []Target{{Name: "nas", Host: "192.168.1.20", Port: 5000}},
+			Profiles:        []ProfileConfig{{ID: "a", Name: strings.Repeat("n", 64)}, {ID: "b"}},
+		}, nil},
+		{"host", Config{Host: "ftp://netpass.example.com"}, []string{`host: "ftp://netpass.example.com" is not an http(s) URL`}},
+		{"host without address", Config{Host: "https://"}, []string{`host: "https://" is not an http(s) URL`}},
+		{"name too short", Config{Name: "ab"}, []string{`name: "ab" must be 3-64 characters`}},
+		{"name too long", Config{Name: strings.Repeat("n", 65)}, []string{`name: "` + strings.Repeat("n", 65) + `" must be 3-64 characters`}},
+		{"auth mode", Config{AuthMode: "token"}, []string{`auth_mode: "token" is not one of api_key, keypair`}},
+		{"update interval", Config{UpdateInterval: "daily"}, []string{`update_interval: invalid duration "daily"`}},
+		{"negative shutdown grace", Config{ShutdownGrace: "-5s"}, []string{"shutdown_grace: must not be negative"}},
+		{"update channel", Config{UpdateChannel: "nightly"}, []string{`update_channel: "nightly" is not one of stable, beta`}},
+		{"update public key", Config{UpdatePublicKey: base64.StdEncoding.EncodeToString([]byte("short"))}, []string{"update_public_key: must be a base64 ed25519 public key"}},
+		{"log level", Config{Log: LogConfig{Level: "verbose"}}, []string{`log.level: "verbose" is not one of debug, info, warn, warning, error`}},
+		{"negative numbers", Config{StreamChunkSize: -1, Log: LogConfig{MaxBackups: -1}}, []string{
+			"stream_chunk_size: must not be negative",
+			"log.max_backups: must not be negative",
+		}},
+		{"timeout", Config{Timeouts: &TimeoutConfig{Header: "1x"}}, []string{`timeouts.header: invalid duration "1x"`}},
+		{"timeout port", Config{Timeouts: &TimeoutConfig{Ports: map[string]PortTimeouts{"http": {}}}}, []string{`timeouts.ports: invalid port "http"`}},
+		{"timeout per port", Config{Timeouts: &TimeoutConfig{Ports: map[string]PortTimeouts{"8080": {Total: "-1s"}}}}, []string{"timeouts.ports.8080.total: must not be negative"}},
+		{"worker concurrency", Config{Workers: &WorkerConfig{HTTP: &PoolConfig{Concurrency: 0}}}, []string{"workers.http.concurrency: must be at least 1"}},
+		{"worker queue", Config{Workers: &WorkerConfig{TCP: &PoolConfig{Concurrency: 1, Queue: -1}}}, []string{"workers.tcp.queue: must not be negative"}},
+		{"worker queue timeout", Config{Workers: &WorkerConfig{QueueTimeout: "soon"}}, []string{`workers.queue_timeout: invalid duration "soon"`}},
+		{"local http idle conns", Config{LocalHTTP: &LocalHTTPConfig{MaxIdleConns: -1}}, []string{"local_http.max_idle_conns: must not be negative"}},
+		{"local http https port", Config{LocalHTTP: &LocalHTTPConfig{HTTPSPorts: []string{"0"}}}, []string{`local_http.https_ports: invalid port "0"`}},
+		{"port policy", Config{Ports: &PortPolicy{Allow: []PortRule{{Port: 70000}}}}, []string{"ports.allow: invalid port 70000"}},
+		{"port policy type", Config{Ports: &PortPolicy{Allow: []PortRule{{Port: 53, Types: []string{"udp"}}}}}, []string{`ports.allow: port 53: unknown type "udp"`}},
+		{"duplicate target", Config{Targets: []Target{{Name: "nas", Host: "a", Port: 1}, {Name: "NAS", Host: "b", Port: 2}}}, []string{`targets: duplicate name "NAS"`}},
+		{"mqtt password", Config{MQTT: &MQTTConfig{Password: "a", PasswordFile: "b"}}, []string{"mqtt.password: password and password_file cannot be used together"}},
+		{"profiles", Config{Profiles: []ProfileConfig{
+			{ID: "a", Ports: &PortPolicy{Deny: []int{0}}},
+			{ID: "a", Name: "x", AuthMode: "token"},
+		}}, []string{
+			"profiles[0].ports.deny: invalid port 0",
+			`profiles[1].id: duplicate id "a"`,
+			`profiles[1].name: "x" must be 3-64 characters`,
+			`profiles[1].auth_mode: "token" is not one of api_key, keypair`,
+		}},
+		{"every problem is reported", Config{Name: "ab", UpdateChannel: "nightly", Workers: &WorkerConfig{HTTP: &PoolConfig{}}}, []string{
+			`name: "ab" must be 3-64 characters`,
+			"workers.http.concurrency: must be at least 1",
+			`update_channel: "nightly" is not one of stable, beta`,
+		}},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			var _got []string
+			for _, _p := range _tt.config.validate() {
+				_got = append(_got, _p.String())
+			}
+			if !slices.Equal(_got, _tt.want) {
+				t.Fatalf("got problems\n\t%s\nwant\n\t%s", strings.Join(_got, "\n\t"), strings.Join(_tt.want, "\n\t"))
+			}
+		})
+	}
+}
@@ -18,7 +18,7 @@ type GUI struct {
 func createGUI() *GUI {
 
 	_info := "Now, you can access your local http service or websocket service.\nHere is the link : \n\n%s\n\n%s\n\n"
-	_url := Global.config.Host + "/pass/" + Global.hwID + "/{local_port}"
+	_url := primaryProfile().publicURL() + "{local_port}"
 	_wss := strings.Replace(_url, "https", "wss", 1)
 
 	fmt.Println(fmt.Sprintf(_info, _url, _wss))
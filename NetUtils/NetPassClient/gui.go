@@ -128,7 +128,7 @@ func (_this *GUI) ShowAbout() {
 
 		widget.NewLabel("About\n\n"+_info),
 		widget.NewSeparator(),
-		widget.NewLabel("Allcated ID : "+Global.hwID+"\nMore detail : "),
+		widget.NewLabel("Allcated ID : "+primaryProfile().assignedID()+"\nMore detail : "),
 		_githubLink,
 		widget.NewLabel(""),
 		widget.NewSeparator(),
@@ -145,11 +145,11 @@ func (_this *GUI) ShowAbout() {
 func (_this *GUI) ShowInfo() {
 
 	_info := "web : \n%s\n\nwss :\n%s\n\n"
-	_url := Global.config.Host + "/pass/" + Global.hwID + "/{local_port}"
+	_url := primaryProfile().publicURL() + "{local_port}"
 	_wss := strings.Replace(_url, "https", "wss", 1)
 
 	_content := container.NewVBox(
-		widget.NewLabel("Allcated ID : "+Global.hwID),
+		widget.NewLabel("Allcated ID : "+primaryProfile().assignedID()),
 		widget.NewSeparator(),
 		widget.NewLabel("Now, you can access your Local Net Service."),
 		widget.NewSeparator(),
@@ -0,0 +1,632 @@
+package main
+
+// -------------------------
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// 起始列與 Header 的大小上限 (與 net/http 的預設值相同)
+const maxHeaderBytes = 1 << 20
+
+// 本地服務在讀完請求主體前就已回應時，回應結束後等待主體送完的上限，逾時即關閉隧道
+const localBodyWait = 5 * time.Second
+
+// -------------------------
+var errHeaderTooLarge = errors.New("header too large")
+var errMalformedChunk = errors.New("malformed chunked encoding")
+
+// -------------------------
+// 本地服務 (host:port) 是否使用 TLS 的偵測結果 (MQTT 模式)，之後的連線直接沿用
+var localTLSAddrs sync.Map
+
+// -------------------------
+// tunnelStream 將 tunnelConn 的訊息視為連續的位元組流
+type tunnelStream struct {
+	conn    tunnelConn
+	kind    string
+	pending []byte
+}
+
+// -------------------------
+func (_this *tunnelStream) Read(b []byte) (int, error) {
+	for len(_this.pending) == 0 {
+		_, _data, err := _this.conn.ReadMessage()
+		if err != nil {
+			// 伺服器正常關閉隧道視為資料結束
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		_this.pending = _data
+	}
+	_n := copy(b, _this.pending)
+	_this.pending = _this.pending[_n:]
+	metricTunnelBytes.Add(float64(_n), _this.kind, "to_local")
+	return _n, nil
+}
+
+// -------------------------
+func (_this *tunnelStream) Write(b []byte) (int, error) {
+	if err := _this.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	metricTunnelBytes.Add(float64(len(b)), _this.kind, "to_server")
+	return len(b), nil
+}
+
+// -------------------------
+// localHTTPConn 是 http_tunnel 對本地服務的連線，同一個隧道中的請求共用 (Keep-Alive)
+type localHTTPConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// -------------------------
+// httpTunnel 在 WSS 隧道上轉送原始的 HTTP/1.1 請求與回應
+type httpTunnel struct {
+	profile *Profile
+	payload HttpRequestPayload
+	log     *sessionLogger
+	host    string
+	port    string
+	address string
+	tunnel  tunnelConn
+	stream  *tunnelStream
+	reader  *bufio.Reader // 伺服器送來的請求
+	writer  *bufio.Writer // 回傳給伺服器的回應
+	lock    sync.Mutex
+	local   *localHTTPConn
+	closed  bool
+}
+
+// -------------------------
+// handleHTTPTunnel 建立與伺服器的 WSS 隧道並轉送原始的 HTTP/1.1 請求 (http_tunnel)
+// 與 MQTT JSON 模式不同，Header 與主體的原始內容 (含 Chunked 編碼與 Trailer) 都原樣轉送，只改寫 Host，也沒有大小與時間限制
+func (_this *Profile) handleHTTPTunnel(payload HttpRequestPayload) {
+	_log := _this.tunnelLog(payload.Token)
+
+	// 1. 檢查目標主機與 Port 是否開放給 HTTP 流量
+	_host, _port, err := _this.resolveTarget(payload, kindHTTP)
+	if err != nil {
+		_log.Warnf("[Policy] Rejected HTTP tunnel to %s:%s: %v", payload.TargetHost, payload.TargetPort, err)
+		recordRequest(_this.settings().ID, kindHTTP, payload.Token, payload.TargetHost+":"+payload.TargetPort, err.Error(), http.StatusForbidden, time.Now())
+		metricRejected.Inc(kindHTTP, "policy")
+		_this.rejectTunnel(payload, websocket.ClosePolicyViolation, "403 Forbidden: "+err.Error())
+		return
+	}
+
+	// 2. 連線到伺服器的 WSS 隧道
+	_tunnel, err := _this.openTunnel(payload.Token)
+	if err != nil {
+		_log.Errorf("[HTTP Tunnel] Server connection failed: %v", err)
+		return
+	}
+
+	_stream := &tunnelStream{conn: _tunnel, kind: kindHTTP}
+	_t := &httpTunnel{
+		profile: _this,
+		payload: payload,
+		log:     _log,
+		host:    _host,
+		port:    _port,
+		address: net.JoinHostPort(_host, _port),
+		tunnel:  _tunnel,
+		stream:  _stream,
+		reader:  bufio.NewReader(_stream),
+		writer:  bufio.NewWriter(_stream),
+	}
+	defer _t.close()
+
+	_end := trackSession(_this.settings().ID, kindHTTP, payload.Token, _t.address, payload, _t.close)
+	defer _end()
+	metricTunnelsOpened.Inc(kindHTTP)
+
+	// 3. 逐一轉送請求，直到任一方關閉連線
+	for {
+		_req, err := readRawRequest(_t.reader)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				_log.Warnf("[HTTP Tunnel] Invalid request: %v", err)
+				_t.writeError(http.StatusBadRequest, err)
+			}
+			return
+		}
+		if !_t.serve(_req) {
+			return
+		}
+	}
+}
+
+// -------------------------
+// rawRequest 是請求的原始起始列與 Header，parsed 只用來判斷主體的長度與連線是否保留
+type rawRequest struct {
+	header []byte
+	parsed *http.Request
+}
+
+// -------------------------
+// rawResponse 是回應的原始起始列與 Header
+type rawResponse struct {
+	header []byte
+	parsed *http.Response
+}
+
+// -------------------------
+// readHeaderBlock 讀取起始列與 Header 直到空行，回傳原始內容；開頭的空行略過
+func readHeaderBlock(reader *bufio.Reader) ([]byte, error) {
+	var _block []byte
+	for {
+		_line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// 單行超過緩衝區，繼續讀到行尾
+			_block = append(_block, _line...)
+			if len(_block) > maxHeaderBytes {
+				return nil, errHeaderTooLarge
+			}
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(_block) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(_block) == 0 && isBlankLine(_line) {
+			continue
+		}
+		_block = append(_block, _line...)
+		if len(_block) > maxHeaderBytes {
+			return nil, errHeaderTooLarge
+		}
+		if isBlankLine(_line) {
+			return _block, nil
+		}
+	}
+}
+
+// -------------------------
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// -------------------------
+// readRawRequest 讀取伺服器送來的請求起始列與 Header，主體留在 reader 中
+func readRawRequest(reader *bufio.Reader) (*rawRequest, error) {
+	_header, err := readHeaderBlock(reader)
+	if err != nil {
+		return nil, err
+	}
+	_parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(_header)))
+	if err != nil {
+		return nil, err
+	}
+	return &rawRequest{header: _header, parsed: _parsed}, nil
+}
+
+// -------------------------
+// readRawResponse 讀取本地服務的回應起始列與 Header，主體留在 reader 中
+func readRawResponse(reader *bufio.Reader, req *http.Request) (*rawResponse, error) {
+	_header, err := readHeaderBlock(reader)
+	if err != nil {
+		return nil, err
+	}
+	_parsed, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(_header)), req)
+	if err != nil {
+		return nil, err
+	}
+	return &rawResponse{header: _header, parsed: _parsed}, nil
+}
+
+// -------------------------
+// withHost 將原始 Header 中的 Host 改為 host (放在起始列之後)，其餘內容不變
+func withHost(header []byte, host string) []byte {
+	_lines := bytes.SplitAfter(header, []byte("\n"))
+	_out := make([]byte, 0, len(header)+len(host)+8)
+	_out = append(_out, _lines[0]...)
+	_out = append(_out, "Host: "+host+"\r\n"...)
+	for _, _line := range _lines[1:] {
+		if _name, _, ok := bytes.Cut(_line, []byte(":")); ok && bytes.EqualFold(bytes.TrimSpace(_name), []byte("Host")) {
+			continue
+		}
+		_out = append(_out, _line...)
+	}
+	return _out
+}
+
+// -------------------------
+// requestBody 回傳請求主體的長度，chunked 為 true 時依 Chunked 編碼轉送
+func requestBody(req *http.Request) (int64, bool) {
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		return 0, true
+	}
+	return req.ContentLength, false
+}
+
+// -------------------------
+// responseBody 回傳回應主體的長度 (-1 代表讀到本地服務關閉連線為止)，chunked 為 true 時依 Chunked 編碼轉送
+func responseBody(resp *http.Response, method string) (int64, bool) {
+	_status := resp.StatusCode
+	if method == http.MethodHead || _status/100 == 1 || _status == http.StatusNoContent || _status == http.StatusNotModified {
+		return 0, false
+	}
+	if len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked" {
+		return 0, true
+	}
+	return resp.ContentLength, false
+}
+
+// -------------------------
+// relayBody 依長度或 Chunked 編碼原樣轉送主體
+func relayBody(dst *bufio.Writer, src *bufio.Reader, length int64, chunked bool) error {
+	if chunked {
+		return copyChunked(dst, src)
+	}
+	if length == 0 {
+		return dst.Flush()
+	}
+	return copyFlush(dst, src, length)
+}
+
+// -------------------------
+// copyFlush 複製 n 個位元組 (n < 0 代表直到 EOF)，每次讀取後立即送出，串流回應 (例如 SSE) 不會卡在緩衝區中
+func copyFlush(dst *bufio.Writer, src io.Reader, n int64) error {
+	if n >= 0 {
+		src = io.LimitReader(src, n)
+	}
+	_buf := make([]byte, 32*1024)
+	var _copied int64
+	for {
+		_n, err := src.Read(_buf)
+		if _n > 0 {
+			if _, err := dst.Write(_buf[:_n]); err != nil {
+				return err
+			}
+			if err := dst.Flush(); err != nil {
+				return err
+			}
+			_copied += int64(_n)
+		}
+		if err == io.EOF {
+			if n >= 0 && _copied < n {
+				return io.ErrUnexpectedEOF
+			}
+			return dst.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// -------------------------
+// copyChunked 原樣轉送 Chunked 編碼的主體，chunk extension 與 Trailer 都保留
+func copyChunked(dst *bufio.Writer, src *bufio.Reader) error {
+	for {
+		_line, err := readChunkLine(src)
+		if err != nil {
+			return err
+		}
+		_size, err := parseChunkSize(_line)
+		if err != nil {
+			return err
+		}
+		dst.Write(_line)
+
+		if _size == 0 {
+			// Trailer 直到空行
+			for {
+				_line, err := readChunkLine(src)
+				if err != nil {
+					return err
+				}
+				dst.Write(_line)
+				if isBlankLine(_line) {
+					return dst.Flush()
+				}
+			}
+		}
+
+		if err := copyFlush(dst, src, _size); err != nil {
+			return err
+		}
+		_end, err := readChunkLine(src)
+		if err != nil {
+			return err
+		}
+		if !isBlankLine(_end) {
+			return errMalformedChunk
+		}
+		dst.Write(_end)
+	}
+}
+
+// -------------------------
+// readChunkLine 讀取一行 chunk size 或 Trailer
+func readChunkLine(src *bufio.Reader) ([]byte, error) {
+	_line, err := src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errHeaderTooLarge
+	}
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), _line...), nil
+}
+
+// -------------------------
+// parseChunkSize 解析 chunk size，忽略 chunk extension
+func parseChunkSize(line []byte) (int64, error) {
+	_size, _, _ := bytes.Cut(bytes.TrimRight(line, "\r\n"), []byte(";"))
+	_n, err := strconv.ParseInt(string(bytes.TrimSpace(_size)), 16, 64)
+	if err != nil || _n < 0 {
+		return 0, errMalformedChunk
+	}
+	return _n, nil
+}
+
+// -------------------------
+// serve 轉送一個請求，回傳是否能繼續在同一個隧道上處理下一個請求
+func (_this *httpTunnel) serve(req *rawRequest) bool {
+	_started := time.Now()
+	_method, _path := req.parsed.Method, req.parsed.URL.RequestURI()
+
+	// 強制設定 Host 為目標主機，避免被 Web Server 拒絕 (與 MQTT 模式相同)
+	req.header = withHost(req.header, _this.host)
+
+	_resp, _written, err := _this.roundTrip(req)
+
+	_status := http.StatusBadGateway
+	if err == nil {
+		_status = _resp.parsed.StatusCode
+	}
+	recordRequest(_this.profile.settings().ID, kindHTTP, _this.payload.Token, _this.address, _method+" "+_path, _status, _started)
+	metricHTTPRequests.Inc(_this.port, _method, strconv.Itoa(_status))
+	metricHTTPDuration.Observe(time.Since(_started).Seconds(), _this.port, _method)
+
+	if err != nil {
+		_this.log.Errorf("[HTTP Tunnel] Local request failed: %v", err)
+		_this.writeError(http.StatusBadGateway, err)
+		return false
+	}
+
+	// 協定升級 (例如 WebSocket) 後改為雙向轉送原始資料
+	if _resp.parsed.StatusCode == http.StatusSwitchingProtocols {
+		if err := _this.writeHeader(_resp.header); err != nil {
+			return false
+		}
+		_this.pipe()
+		return false
+	}
+
+	_local, ok := _this.currentLocal()
+	if !ok {
+		return false
+	}
+	_length, _chunked := responseBody(_resp.parsed, _method)
+	if err := _this.writeHeader(_resp.header); err != nil {
+		return false
+	}
+	if err := relayBody(_this.writer, _local.reader, _length, _chunked); err != nil {
+		_this.log.Warnf("[HTTP Tunnel] Failed to relay response: %v", err)
+		return false
+	}
+
+	// 本地服務可能在讀完請求主體前就回應，等請求送完才能讀取下一個請求
+	// 本地服務不再讀取主體時不會送完，等待有上限，逾時即關閉本地連線與隧道
+	select {
+	case err := <-_written:
+		if err != nil {
+			return false
+		}
+	case <-time.After(localBodyWait):
+		_this.log.Warnf("[HTTP Tunnel] Local service answered without reading the request body, closing the tunnel")
+		_this.dropLocal()
+		return false
+	}
+	return !req.parsed.Close && !_resp.parsed.Close && (_length >= 0 || _chunked)
+}
+
+// -------------------------
+// roundTrip 將請求送到本地服務並讀取回應的 Header，回應主體留在本地連線中
+// 沿用的 Keep-Alive 連線可能已被本地服務關閉，沒有主體的請求以新連線重送一次
+func (_this *httpTunnel) roundTrip(req *rawRequest) (*rawResponse, <-chan error, error) {
+	_length, _chunked := requestBody(req.parsed)
+	_hasBody := _length > 0 || _chunked
+
+	for {
+		_local, _fresh, err := _this.localConn()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// 有主體時在背景送出，本地服務可先回應 100 Continue 再讀取主體
+		_written := make(chan error, 1)
+		if _hasBody {
+			go func() { _written <- _this.writeLocalRequest(_local, req, _length, _chunked) }()
+		} else {
+			_written <- _this.writeLocalRequest(_local, req, 0, false)
+		}
+
+		_resp, err := _this.readResponse(_local, req)
+		if err == nil {
+			return _resp, _written, nil
+		}
+		_this.dropLocal()
+
+		if !_fresh && !_hasBody {
+			continue
+		}
+		return nil, nil, err
+	}
+}
+
+// -------------------------
+// readResponse 讀取本地服務的回應，1xx 中間回應 (101 除外) 轉給伺服器後繼續等待
+func (_this *httpTunnel) readResponse(local *localHTTPConn, req *rawRequest) (*rawResponse, error) {
+	for {
+		_resp, err := readRawResponse(local.reader, req.parsed)
+		if err != nil {
+			return nil, err
+		}
+		_status := _resp.parsed.StatusCode
+		if _status >= 100 && _status < 200 && _status != http.StatusSwitchingProtocols {
+			if err := _this.writeHeader(_resp.header); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return _resp, nil
+	}
+}
+
+// -------------------------
+// writeLocalRequest 將原始的請求 Header 與主體寫入本地連線
+func (_this *httpTunnel) writeLocalRequest(local *localHTTPConn, req *rawRequest, length int64, chunked bool) error {
+	if _, err := local.writer.Write(req.header); err != nil {
+		return err
+	}
+	return relayBody(local.writer, _this.reader, length, chunked)
+}
+
+// -------------------------
+// writeHeader 將原始的狀態列與 Header 寫回隧道
+func (_this *httpTunnel) writeHeader(header []byte) error {
+	if _, err := _this.writer.Write(header); err != nil {
+		return err
+	}
+	return _this.writer.Flush()
+}
+
+// -------------------------
+// writeError 回傳錯誤並要求伺服器關閉連線
+func (_this *httpTunnel) writeError(code int, err error) {
+	_body := fmt.Sprintf("%d %s: %v\n", code, http.StatusText(code), err)
+	fmt.Fprintf(_this.writer, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(_body), _body)
+	_this.writer.Flush()
+}
+
+// -------------------------
+// pipe 協定升級後雙向轉送原始資料，直到任一方關閉
+func (_this *httpTunnel) pipe() {
+	_local, ok := _this.currentLocal()
+	if !ok {
+		return
+	}
+
+	_errChan := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(_local.conn, _this.reader)
+		_errChan <- err
+	}()
+	go func() {
+		_, err := io.Copy(_this.stream, _local.reader)
+		_errChan <- err
+	}()
+	<-_errChan
+}
+
+// -------------------------
+// currentLocal 回傳目前的本地連線，已關閉時第二個回傳值為 false
+func (_this *httpTunnel) currentLocal() (*localHTTPConn, bool) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	return _this.local, _this.local != nil
+}
+
+// -------------------------
+// localConn 回傳目前的本地連線，沒有可用的連線時建立新連線；第二個回傳值表示是否為新連線
+func (_this *httpTunnel) localConn() (*localHTTPConn, bool, error) {
+	if _local, ok := _this.currentLocal(); ok {
+		return _local, false, nil
+	}
+
+	_local, err := _this.dialLocal()
+	if err != nil {
+		return nil, true, err
+	}
+
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	if _this.closed {
+		_local.conn.Close()
+		return nil, true, net.ErrClosed
+	}
+	_this.local = _local
+	return _local, true, nil
+}
+
+// -------------------------
+// dropLocal 關閉目前的本地連線
+func (_this *httpTunnel) dropLocal() {
+	_this.lock.Lock()
+	_local := _this.local
+	_this.local = nil
+	_this.lock.Unlock()
+	if _local != nil {
+		_local.conn.Close()
+	}
+}
+
+// -------------------------
+// close 關閉隧道與本地連線，可重複呼叫 (管理 API 中斷連線時也會呼叫)
+func (_this *httpTunnel) close() {
+	_this.lock.Lock()
+	_this.closed = true
+	_this.lock.Unlock()
+	_this.tunnel.Close()
+	_this.dropLocal()
+}
+
+// -------------------------
+// dialLocal 連線到本地服務，local_http.https_ports 中的 Port (或 MQTT 模式已知為 HTTPS 的服務) 使用 TLS，不驗證憑證 (支援本機自簽憑證)
+// 原始轉送無法像 MQTT 模式在失敗後以 HTTPS 重送 (請求主體已送出，且 HTTPS 服務常以 400 回應純 HTTP 請求)，因此依設定決定
+func (_this *httpTunnel) dialLocal() (*localHTTPConn, error) {
+	_config := currentConfig()
+	_timeouts := _config.Timeouts.forPort(_this.port)
+	_conn, err := _timeouts.dialer().Dial("tcp", _this.address)
+	if err != nil {
+		return nil, err
+	}
+
+	_useTLS, _known := localTLSAddrs.Load(_this.address)
+	if !_config.LocalHTTP.usesHTTPS(_this.port) && !(_known && _useTLS.(bool)) {
+		return newLocalHTTPConn(_conn), nil
+	}
+
+	// TLS 交握計入連線逾時
+	_tlsConn := tls.Client(_conn, &tls.Config{InsecureSkipVerify: true, ServerName: _this.host, NextProtos: []string{"http/1.1"}})
+	if _timeouts.connect > 0 {
+		_tlsConn.SetDeadline(time.Now().Add(_timeouts.connect))
+	}
+	err = _tlsConn.Handshake()
+	_tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		_conn.Close()
+		return nil, err
+	}
+	return newLocalHTTPConn(_tlsConn), nil
+}
+
+// -------------------------
+func newLocalHTTPConn(conn net.Conn) *localHTTPConn {
+	return &localHTTPConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+}
@@ -0,0 +1,298 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+const defaultIdentityFile = "identity.json"
+
+// 裝置身分的來源
+const identitySourceMAC = "mac"             // 由舊版的 MAC Address 雜湊遷移，升級後 ID 不變
+const identitySourceGenerated = "generated" // 隨機產生
+
+// -------------------------
+// Identity 是保存在 identity.json 的裝置身分，第一次執行時建立，之後不再隨網路介面變動
+type Identity struct {
+	ID         string `json:"id"`                    // 12 位十六進位的裝置 ID，向伺服器註冊時使用
+	Source     string `json:"source"`                // mac / generated
+	Created    int64  `json:"created"`               // Unix 秒
+	PrivateKey string `json:"private_key,omitempty"` // 金鑰認證用的 ed25519 私鑰種子 (Base64)，第一次需要時產生
+}
+
+// -------------------------
+var identityPattern = regexp.MustCompile(`^[0-9a-f]{12}$`)
+var identityLock sync.Mutex
+var identityCache *Identity
+
+// -------------------------
+// identityPath 回傳身分檔路徑，未設定 identity_file 時放在設定檔所在目錄
+func (_this *Config) identityPath() string {
+	_path := strings.TrimSpace(_this.IdentityFile)
+	if _path == "" {
+		_path = filepath.Join(filepath.Dir(configPath), defaultIdentityFile)
+	}
+	if _abs, err := filepath.Abs(_path); err == nil {
+		_path = _abs
+	}
+	return _path
+}
+
+// -------------------------
+// getHardwareID 回傳裝置 ID，取自身分檔；身分檔不存在時建立，無法寫入時仍以本次產生的 ID 執行
+func getHardwareID() string {
+	_identity, err := loadIdentity()
+	if err != nil {
+		logErrorf("Failed to load device identity: %v", err)
+		return ""
+	}
+	return _identity.ID
+}
+
+// -------------------------
+// loadIdentity 讀取身分檔，不存在時由 MAC Address 雜湊遷移 (找不到網路介面時隨機產生) 並寫入
+func loadIdentity() (Identity, error) {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+
+	if identityCache != nil {
+		return *identityCache, nil
+	}
+
+	_path := currentConfig().identityPath()
+	_identity, err := readIdentity(_path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_identity = newIdentity()
+		if err := writeIdentity(_path, _identity); err != nil {
+			logWarnf("Failed to save device identity to %s: %v. The ID may change on the next start.", _path, err)
+		} else {
+			logInfof("Created device identity %s (%s) in %s", _identity.ID, _identity.Source, _path)
+		}
+	} else if err != nil {
+		return Identity{}, fmt.Errorf("%s: %w", _path, err)
+	}
+
+	identityCache = &_identity
+	return _identity, nil
+}
+
+// -------------------------
+// deviceKey 回傳裝置的 ed25519 私鑰，身分檔中沒有金鑰時產生並寫回身分檔
+// 私鑰無法保存時回傳錯誤，避免每次啟動都以不同的公鑰向伺服器登記
+func deviceKey() (ed25519.PrivateKey, error) {
+	if _, err := loadIdentity(); err != nil {
+		return nil, err
+	}
+
+	identityLock.Lock()
+	defer identityLock.Unlock()
+
+	if identityCache.PrivateKey != "" {
+		return identityCache.privateKey()
+	}
+
+	_seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(_seed); err != nil {
+		return nil, err
+	}
+	_identity := *identityCache
+	_identity.PrivateKey = base64.StdEncoding.EncodeToString(_seed)
+
+	_path := currentConfig().identityPath()
+	if err := writeIdentity(_path, _identity); err != nil {
+		return nil, fmt.Errorf("cannot save device key to %s: %w", _path, err)
+	}
+	logInfof("Created device key in %s", _path)
+
+	identityCache = &_identity
+	return _identity.privateKey()
+}
+
+// -------------------------
+// privateKey 解出身分檔中的私鑰
+func (_this *Identity) privateKey() (ed25519.PrivateKey, error) {
+	_seed, err := base64.StdEncoding.DecodeString(_this.PrivateKey)
+	if err != nil || len(_seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid private_key in identity file")
+	}
+	return ed25519.NewKeyFromSeed(_seed), nil
+}
+
+// -------------------------
+// publicKey 回傳 Base64 公鑰，尚未產生金鑰時回傳空字串
+func (_this *Identity) publicKey() string {
+	_key, err := _this.privateKey()
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(_key.Public().(ed25519.PublicKey))
+}
+
+// -------------------------
+// readIdentity 讀取並檢查身分檔
+func readIdentity(path string) (Identity, error) {
+	var _identity Identity
+	_data, err := os.ReadFile(path)
+	if err != nil {
+		return _identity, err
+	}
+	if err := json.Unmarshal(_data, &_identity); err != nil {
+		return _identity, err
+	}
+	if !identityPattern.MatchString(_identity.ID) {
+		return _identity, fmt.Errorf("invalid id %q", _identity.ID)
+	}
+	if _identity.PrivateKey != "" {
+		if _, err := _identity.privateKey(); err != nil {
+			return _identity, err
+		}
+	}
+	return _identity, nil
+}
+
+// -------------------------
+// writeIdentity 寫入身分檔，先寫入暫存檔再改名，避免中斷時留下不完整的檔案
+func writeIdentity(path string, identity Identity) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_data, _ := json.MarshalIndent(identity, "", "  ")
+	_tmp := path + ".tmp"
+	if err := os.WriteFile(_tmp, append(_data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(_tmp, path)
+}
+
+// -------------------------
+// newIdentity 建立新的身分，優先沿用舊版的 MAC Address 雜湊，讓升級前的網址維持不變
+func newIdentity() Identity {
+	if _id := macHardwareID(); _id != "" {
+		return Identity{ID: _id, Source: identitySourceMAC, Created: time.Now().Unix()}
+	}
+	return randomIdentity()
+}
+
+// -------------------------
+// randomIdentity 隨機產生新的身分
+func randomIdentity() Identity {
+	_buf := make([]byte, 6)
+	rand.Read(_buf)
+	return Identity{ID: hex.EncodeToString(_buf), Source: identitySourceGenerated, Created: time.Now().Unix()}
+}
+
+// -------------------------
+// macHardwareID 透過 MAC Address 產生 12 位元硬體識別碼 (舊版的裝置 ID，只用於遷移)
+// 網路介面的增減或順序改變都會改變結果，因此不再直接作為裝置 ID
+func macHardwareID() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var hardwareData string
+	for _, i := range interfaces {
+		if i.HardwareAddr.String() != "" {
+			hardwareData += i.HardwareAddr.String()
+		}
+	}
+
+	if hardwareData == "" {
+		return ""
+	}
+
+	hash := sha256.Sum256([]byte(hardwareData))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// -------------------------
+// cmdIdentity 處理 identity show / export / reset 子命令
+func cmdIdentity(opts cliOptions, action string) int {
+	_path := currentConfig().identityPath()
+
+	switch action {
+	case "show":
+		_identity, err := loadIdentity()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if opts.json {
+			_data, _ := json.MarshalIndent(map[string]any{
+				"id":         _identity.ID,
+				"source":     _identity.Source,
+				"created":    time.Unix(_identity.Created, 0).Format(time.RFC3339),
+				"public_key": _identity.publicKey(),
+				"file":       _path,
+			}, "", "  ")
+			fmt.Println(string(_data))
+			return 0
+		}
+		fmt.Printf("ID:      %s\n", _identity.ID)
+		fmt.Printf("Source:  %s\n", _identity.Source)
+		fmt.Printf("Created: %s\n", time.Unix(_identity.Created, 0).Format(time.RFC3339))
+		if _key := _identity.publicKey(); _key != "" {
+			fmt.Printf("Key:     %s\n", _key)
+		} else {
+			fmt.Printf("Key:     (not generated yet)\n")
+		}
+		fmt.Printf("File:    %s\n", _path)
+		return 0
+
+	case "export":
+		// 輸出完整的身分檔，搬到新主機的 identity_file 位置即可沿用相同的 ID 與金鑰
+		_identity, err := loadIdentity()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if _identity.PrivateKey != "" {
+			fmt.Fprintln(os.Stderr, "Warning: the output contains the device private key. Keep it secret.")
+		}
+		_data, _ := json.MarshalIndent(_identity, "", "  ")
+		fmt.Println(string(_data))
+		return 0
+
+	case "reset":
+		_old, _ := readIdentity(_path)
+		if _old.ID != "" {
+			if err := writeIdentity(_path+".bak", _old); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to back up %s: %v\n", _path, err)
+				return 1
+			}
+		}
+		_identity := randomIdentity()
+		if err := writeIdentity(_path, _identity); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if _old.ID != "" {
+			fmt.Printf("Device ID changed from %s to %s (previous identity saved to %s.bak).\n", _old.ID, _identity.ID, _path)
+		} else {
+			fmt.Printf("Device ID set to %s.\n", _identity.ID)
+		}
+		if _, ok := runningInstance(); ok {
+			fmt.Println("Restart the running instance to use the new ID.")
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown identity command %q (use show, export or reset)\n", action)
+	return 2
+}
@@ -0,0 +1,257 @@
+package main
+
+// -------------------------
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// -------------------------
+const conflictReplace = "replace"
+const conflictRefuse = "refuse"
+
+// -------------------------
+var errInstanceRunning = errors.New("another instance is already running")
+
+// -------------------------
+// InstanceInfo 是寫入鎖定檔的執行中實例資訊，供新啟動的實例或 CLI 找到目前的實例
+type InstanceInfo struct {
+	PID      int    `json:"pid"`
+	Instance string `json:"instance"`
+	Config   string `json:"config"`          // 設定檔的絕對路徑
+	Admin    string `json:"admin,omitempty"` // 管理 API 位址，交接時優先透過 /shutdown 關閉
+	Started  int64  `json:"started"`         // Unix 秒
+}
+
+// -------------------------
+var instanceLock *os.File
+var instanceNamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// -------------------------
+// instanceName 回傳實例名稱，未設定時以設定檔路徑產生，不同設定檔的 Client 可同時執行
+func (_this *Config) instanceName() string {
+	_name := instanceNamePattern.ReplaceAllString(strings.TrimSpace(_this.Instance), "_")
+	if _name != "" {
+		return _name
+	}
+
+	_path, err := filepath.Abs(configPath)
+	if err != nil {
+		_path = configPath
+	}
+	_hash := sha256.Sum256([]byte(_path))
+	return "config-" + hex.EncodeToString(_hash[:4])
+}
+
+// -------------------------
+// onConflict 回傳同名實例已在執行時的處理方式，預設交接 (replace)
+func (_this *Config) onConflict() string {
+	switch strings.ToLower(strings.TrimSpace(_this.OnConflict)) {
+	case "", conflictReplace:
+		return conflictReplace
+	case conflictRefuse:
+		return conflictRefuse
+	default:
+		logWarnf("Unknown on_conflict %q, using %s", _this.OnConflict, conflictReplace)
+		return conflictReplace
+	}
+}
+
+// -------------------------
+// lockFilePath 回傳實例的鎖定檔路徑，位於只有目前使用者可寫入的執行期目錄 (見 lockDir)
+// 不使用所有人都可寫入的暫存目錄，避免其他使用者預先建立或佔用鎖定檔，或寫入假的 PID 與管理 API 位址
+func lockFilePath(instance string) (string, error) {
+	_dir, err := lockDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(_dir, 0700); err != nil {
+		return "", err
+	}
+	if err := checkPrivateDir(_dir); err != nil {
+		return "", fmt.Errorf("refusing to use lock directory %s: %w", _dir, err)
+	}
+	return filepath.Join(_dir, "NetPassClient-"+instance+".lock"), nil
+}
+
+// -------------------------
+// readInstanceInfo 讀取鎖定檔中記錄的實例資訊
+func readInstanceInfo(instance string) (InstanceInfo, error) {
+	var _info InstanceInfo
+	_path, err := lockFilePath(instance)
+	if err != nil {
+		return _info, err
+	}
+	_data, err := os.ReadFile(_path)
+	if err != nil {
+		return _info, err
+	}
+	err = json.Unmarshal(_data, &_info)
+	return _info, err
+}
+
+// -------------------------
+// instanceRunning 回傳實例是否正在執行 (鎖定檔被其他進程持有)
+func instanceRunning(instance string) bool {
+	_path, err := lockFilePath(instance)
+	if err != nil {
+		return false
+	}
+	_file, err := os.OpenFile(_path, os.O_RDWR, 0600)
+	if err != nil {
+		return false
+	}
+	defer _file.Close()
+
+	if err := lockFile(_file); err != nil {
+		return true
+	}
+	unlockFile(_file)
+	return false
+}
+
+// -------------------------
+// acquireInstanceLock 取得實例鎖定，同名實例已在執行時依 on_conflict 拒絕啟動或請它交接
+func acquireInstanceLock() error {
+	_name := currentConfig().instanceName()
+	_path, err := lockFilePath(_name)
+	if err != nil {
+		return err
+	}
+
+	_file, err := os.OpenFile(_path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open lock file %s: %w", _path, err)
+	}
+
+	if err := lockFile(_file); err != nil {
+		_info, _ := readInstanceInfo(_name)
+		if currentConfig().onConflict() == conflictRefuse {
+			_file.Close()
+			return fmt.Errorf("%w (instance %q, PID %d)", errInstanceRunning, _name, _info.PID)
+		}
+
+		logInfof("Instance %q is already running (PID %d). Asking it to hand over...", _name, _info.PID)
+		if err := replaceInstance(_file, _info); err != nil {
+			_file.Close()
+			return err
+		}
+	}
+
+	// 寫入目前的實例資訊
+	_config, _ := filepath.Abs(configPath)
+	_data, _ := json.Marshal(InstanceInfo{
+		PID:      os.Getpid(),
+		Instance: _name,
+		Config:   _config,
+		Admin:    strings.TrimSpace(currentConfig().Admin.Listen),
+		Started:  time.Now().Unix(),
+	})
+	_file.Truncate(0)
+	_file.WriteAt(_data, 0)
+
+	instanceLock = _file
+	listenShutdownEvent()
+	logInfof("Running as instance %q (lock: %s)", _name, _path)
+	return nil
+}
+
+// -------------------------
+// replaceInstance 請舊實例優雅關閉並等待鎖定釋放，超過 shutdown_grace 仍未結束則強制終止
+func replaceInstance(file *os.File, info InstanceInfo) error {
+	if err := requestShutdown(info); err != nil {
+		logWarnf("Graceful hand-over failed: %v", err)
+	}
+
+	if waitForLock(file, currentConfig().shutdownGrace()+5*time.Second) {
+		return nil
+	}
+
+	logWarnf("PID %d did not exit in time. Killing it...", info.PID)
+	if _process, err := os.FindProcess(info.PID); err == nil && info.PID > 0 {
+		_process.Kill()
+	}
+
+	if waitForLock(file, 5*time.Second) {
+		return nil
+	}
+	return fmt.Errorf("%w (instance %q, PID %d) and could not be stopped", errInstanceRunning, info.Instance, info.PID)
+}
+
+// -------------------------
+// stopInstance 請執行中的實例優雅關閉，並等待它釋放鎖定 (stop 子命令使用)
+func stopInstance(instance string) error {
+	_path, err := lockFilePath(instance)
+	if err != nil {
+		return err
+	}
+	_file, err := os.OpenFile(_path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer _file.Close()
+
+	if lockFile(_file) != nil {
+		_info, _ := readInstanceInfo(instance)
+		if err := replaceInstance(_file, _info); err != nil {
+			return err
+		}
+	}
+	unlockFile(_file)
+	return nil
+}
+
+// -------------------------
+// requestShutdown 優先透過舊實例的管理 API 關閉，沒有管理 API 時送出終止訊號
+func requestShutdown(info InstanceInfo) error {
+	if info.Admin != "" {
+		_client, _base := adminClient(info.Admin)
+		_resp, err := _client.Post(_base+"/shutdown", "application/json", nil)
+		if err == nil {
+			_resp.Body.Close()
+			if _resp.StatusCode == http.StatusAccepted {
+				return nil
+			}
+			err = fmt.Errorf("/shutdown returned %d", _resp.StatusCode)
+		}
+		logWarnf("Admin API of PID %d unreachable: %v", info.PID, err)
+	}
+
+	if info.PID <= 0 {
+		return errors.New("lock file has no PID")
+	}
+	return terminateProcess(info.PID)
+}
+
+// -------------------------
+// waitForLock 在 timeout 內重複嘗試取得鎖定
+func waitForLock(file *os.File, timeout time.Duration) bool {
+	_deadline := time.Now().Add(timeout)
+	for time.Now().Before(_deadline) {
+		if lockFile(file) == nil {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return false
+}
+
+// -------------------------
+// releaseInstanceLock 釋放實例鎖定，背景模式啟動子進程或重新啟動前呼叫
+func releaseInstanceLock() {
+	if instanceLock == nil {
+		return
+	}
+	unlockFile(instanceLock)
+	instanceLock.Close()
+	instanceLock = nil
+}
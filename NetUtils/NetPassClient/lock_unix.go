@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// -------------------------
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// -------------------------
+// lockDir 回傳存放鎖定檔的目錄：root 使用 /run/netpass (無 /run 時為 /var/run/netpass)，
+// 一般使用者使用 $XDG_RUNTIME_DIR/netpass，未設定時使用使用者的快取目錄
+func lockDir() (string, error) {
+	if os.Geteuid() == 0 {
+		if _, err := os.Stat("/run"); err == nil {
+			return "/run/netpass", nil
+		}
+		return "/var/run/netpass", nil
+	}
+	if _runtime := os.Getenv("XDG_RUNTIME_DIR"); _runtime != "" {
+		return filepath.Join(_runtime, "netpass"), nil
+	}
+	_cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(_cache, "NetPassClient"), nil
+}
+
+// -------------------------
+// checkPrivateDir 確認目錄不是符號連結、屬於目前使用者，且其他人無法寫入
+func checkPrivateDir(path string) error {
+	_info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !_info.IsDir() {
+		return errors.New("not a directory")
+	}
+	if _stat, ok := _info.Sys().(*syscall.Stat_t); ok && int(_stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("owned by uid %d", _stat.Uid)
+	}
+	if _info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("writable by other users (mode %v)", _info.Mode().Perm())
+	}
+	return nil
+}
+
+// -------------------------
+// lockFile 以 flock 取得非阻塞的獨佔鎖定，進程結束時由系統自動釋放
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// -------------------------
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// -------------------------
+// terminateProcess 送出 SIGTERM，讓對方排空連線後結束
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// -------------------------
+// listenShutdownEvent 其他實例以 SIGTERM 要求交接 (由 handleSignals 處理)，不需額外的通道
+func listenShutdownEvent() {}
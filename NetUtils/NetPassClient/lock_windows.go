@@ -0,0 +1,95 @@
+//go:build windows
+// +build windows
+
+package main
+
+// -------------------------
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// -------------------------
+// lockDir 回傳存放鎖定檔的目錄 (%LOCALAPPDATA%\NetPassClient)，只有目前使用者可存取
+func lockDir() (string, error) {
+	_dir := os.Getenv("LOCALAPPDATA")
+	if _dir == "" {
+		return "", errors.New("LOCALAPPDATA is not set")
+	}
+	return filepath.Join(_dir, "NetPassClient"), nil
+}
+
+// -------------------------
+// checkPrivateDir 確認不是符號連結 (%LOCALAPPDATA% 的 ACL 已限制為目前使用者)
+func checkPrivateDir(path string) error {
+	_info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !_info.IsDir() {
+		return errors.New("not a directory")
+	}
+	return nil
+}
+
+// -------------------------
+// 鎖定檔案內容以外的位置，避免 Windows 的強制鎖定讓其他進程無法讀取實例資訊
+var lockOverlapped = windows.Overlapped{OffsetHigh: 1}
+
+// -------------------------
+// lockFile 以 LockFileEx 取得非阻塞的獨佔鎖定，進程結束時由系統自動釋放
+func lockFile(file *os.File) error {
+	_overlapped := lockOverlapped
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &_overlapped)
+}
+
+// -------------------------
+func unlockFile(file *os.File) error {
+	_overlapped := lockOverlapped
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &_overlapped)
+}
+
+// -------------------------
+// shutdownEventName 回傳指定進程接收關閉要求的具名事件
+func shutdownEventName(pid int) (*uint16, error) {
+	return windows.UTF16PtrFromString(fmt.Sprintf(`Local\NetPassClient-%d-shutdown`, pid))
+}
+
+// -------------------------
+// listenShutdownEvent 建立關閉事件並在背景等待，事件被設定時與收到 SIGTERM 一樣排空後結束
+// 事件使用預設的安全性描述元，只有目前使用者 (與系統) 可以開啟
+func listenShutdownEvent() {
+	_name, err := shutdownEventName(os.Getpid())
+	if err != nil {
+		return
+	}
+	_event, err := windows.CreateEvent(nil, 1, 0, _name)
+	if err != nil {
+		logWarnf("Failed to create shutdown event: %v", err)
+		return
+	}
+	go func() {
+		if _, err := windows.WaitForSingleObject(_event, windows.INFINITE); err == nil {
+			shutdown("hand-over to another instance")
+		}
+	}()
+}
+
+// -------------------------
+// terminateProcess 在 Windows 上沒有 SIGTERM，改為設定舊實例的關閉事件
+func terminateProcess(pid int) error {
+	_name, err := shutdownEventName(pid)
+	if err != nil {
+		return err
+	}
+	_event, err := windows.OpenEvent(windows.EVENT_MODIFY_STATE, false, _name)
+	if err != nil {
+		return fmt.Errorf("cannot open the shutdown event of PID %d: %v", pid, err)
+	}
+	defer windows.CloseHandle(_event)
+	return windows.SetEvent(_event)
+}
@@ -0,0 +1,379 @@
+package main
+
+// -------------------------
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------
+const defaultLogMaxSizeMB = 10
+const defaultLogMaxAgeDays = 7
+const defaultLogMaxBackups = 5
+
+// 背景模式未設定 log.file 時使用的日誌檔
+const defaultDaemonLogFile = "client.log"
+
+// -------------------------
+// LogConfig 定義日誌等級、格式與輸出檔案
+type LogConfig struct {
+	Level      string `json:"level"`        // debug / info / warn / error，預設 info
+	Format     string `json:"format"`       // text / json，預設 text
+	File       string `json:"file"`         // 日誌檔路徑，空值代表輸出到 stdout (背景模式預設 client.log)
+	MaxSizeMB  int    `json:"max_size_mb"`  // 單一日誌檔大小上限，超過即輪替，預設 10
+	MaxAgeDays int    `json:"max_age_days"` // 日誌檔保留天數，檔案開啟超過一天也會輪替，預設 7
+	MaxBackups int    `json:"max_backups"`  // 保留的舊日誌檔數量，預設 5
+}
+
+// -------------------------
+// appLogger 不會被替換，實際輸出由 logHandler 決定，重新載入設定後已建立的 sessionLogger 也改用新的輸出
+var appLogger = slog.New(&switchHandler{})
+var appLogLevel = new(slog.LevelVar)
+
+// logHandler 與 appLogFile 由 logLock 保護，寫入日誌時持有讀取鎖，替換輸出時等待寫入中的日誌完成
+var logLock sync.RWMutex
+var logHandler slog.Handler = slog.NewTextHandler(os.Stdout, nil)
+var appLogFile *rotatingFile
+
+// -------------------------
+// switchHandler 將日誌交給目前的 logHandler，並在每次替換後重新套用 With 加上的欄位
+type switchHandler struct {
+	wrap   func(slog.Handler) slog.Handler // With / WithGroup 加上的欄位，nil 代表沒有
+	cached atomic.Pointer[wrappedHandler]
+}
+
+// -------------------------
+// wrappedHandler 是套用過欄位的 Handler，base 改變時重新建立
+type wrappedHandler struct {
+	base    slog.Handler
+	handler slog.Handler
+}
+
+// -------------------------
+// sessionLogger 在每一行日誌附上 SessionID 或隧道 Token
+type sessionLogger struct {
+	logger *slog.Logger
+}
+
+// -------------------------
+// initLogging 依設定建立日誌輸出，daemon 為 true 時預設寫入 client.log
+func initLogging(config LogConfig, daemon bool) {
+	switch strings.ToLower(strings.TrimSpace(config.Level)) {
+	case "debug":
+		appLogLevel.Set(slog.LevelDebug)
+	case "warn", "warning":
+		appLogLevel.Set(slog.LevelWarn)
+	case "error":
+		appLogLevel.Set(slog.LevelError)
+	default:
+		appLogLevel.Set(slog.LevelInfo)
+	}
+
+	_path := strings.TrimSpace(config.File)
+	if _path == "" && daemon {
+		_path = defaultDaemonLogFile
+	}
+
+	// 檔案路徑不變時沿用目前的日誌檔，只更新輪替設定
+	logLock.RLock()
+	_current := appLogFile
+	logLock.RUnlock()
+
+	var _writer io.Writer = os.Stdout
+	var _file *rotatingFile
+	if _path != "" && _current != nil && _current.path == _path {
+		_current.configure(config)
+		_file = _current
+		_writer = _file
+	} else if _path != "" {
+		_opened, err := openRotatingFile(_path, config)
+		if err != nil {
+			logErrorf("Failed to open log file %s: %v. Logging to stdout.", _path, err)
+		} else {
+			_file = _opened
+			_writer = _file
+		}
+	}
+
+	_options := &slog.HandlerOptions{Level: appLogLevel}
+	if strings.EqualFold(strings.TrimSpace(config.Format), "json") {
+		setLogHandler(slog.NewJSONHandler(_writer, _options), _file)
+	} else {
+		setLogHandler(slog.NewTextHandler(_writer, _options), _file)
+	}
+}
+
+// -------------------------
+// setLogHandler 替換日誌輸出，寫入中的日誌完成後才關閉不再使用的日誌檔
+func setLogHandler(handler slog.Handler, file *rotatingFile) {
+	logLock.Lock()
+	_old := appLogFile
+	logHandler = handler
+	appLogFile = file
+	logLock.Unlock()
+
+	if _old != nil && _old != file {
+		_old.Close()
+	}
+}
+
+// -------------------------
+// initCLILogging 供 run 以外的子命令使用，日誌只輸出警告以上到 stderr，避免混入命令的輸出
+func initCLILogging() {
+	appLogLevel.Set(slog.LevelWarn)
+	setLogHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: appLogLevel}), nil)
+}
+
+// -------------------------
+// handler 回傳套用欄位後的目前輸出，呼叫前須持有 logLock 的讀取鎖
+func (_this *switchHandler) handler() slog.Handler {
+	if _this.wrap == nil {
+		return logHandler
+	}
+	if _cached := _this.cached.Load(); _cached != nil && _cached.base == logHandler {
+		return _cached.handler
+	}
+	_handler := _this.wrap(logHandler)
+	_this.cached.Store(&wrappedHandler{base: logHandler, handler: _handler})
+	return _handler
+}
+
+// -------------------------
+func (_this *switchHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return logHandler.Enabled(ctx, level)
+}
+
+// -------------------------
+func (_this *switchHandler) Handle(ctx context.Context, record slog.Record) error {
+	logLock.RLock()
+	defer logLock.RUnlock()
+	return _this.handler().Handle(ctx, record)
+}
+
+// -------------------------
+func (_this *switchHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &switchHandler{wrap: _this.chain(func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })}
+}
+
+// -------------------------
+func (_this *switchHandler) WithGroup(name string) slog.Handler {
+	return &switchHandler{wrap: _this.chain(func(h slog.Handler) slog.Handler { return h.WithGroup(name) })}
+}
+
+// -------------------------
+// chain 在既有的欄位之後加上新的欄位
+func (_this *switchHandler) chain(next func(slog.Handler) slog.Handler) func(slog.Handler) slog.Handler {
+	_wrap := _this.wrap
+	if _wrap == nil {
+		return next
+	}
+	return func(h slog.Handler) slog.Handler { return next(_wrap(h)) }
+}
+
+// -------------------------
+// logAt 以 Printf 格式輸出一行日誌，未達等級時不組字串
+func logAt(logger *slog.Logger, level slog.Level, format string, args ...any) {
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
+	logger.Log(context.Background(), level, strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+// -------------------------
+func logDebugf(format string, args ...any) { logAt(appLogger, slog.LevelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logAt(appLogger, slog.LevelInfo, format, args...) }
+func logWarnf(format string, args ...any)  { logAt(appLogger, slog.LevelWarn, format, args...) }
+func logErrorf(format string, args ...any) { logAt(appLogger, slog.LevelError, format, args...) }
+
+// -------------------------
+// newLog 建立附帶固定欄位 (例如 profile、session) 的日誌
+func newLog(args ...any) *sessionLogger {
+	return &sessionLogger{logger: appLogger.With(args...)}
+}
+
+// -------------------------
+// With 回傳多附帶欄位的日誌
+func (_this *sessionLogger) With(args ...any) *sessionLogger {
+	return &sessionLogger{logger: _this.logger.With(args...)}
+}
+
+// -------------------------
+// shortToken 只保留隧道 Token 的前 8 碼，避免 Token 外洩到日誌
+func shortToken(token string) string {
+	if len(token) > 8 {
+		return token[:8] + "…"
+	}
+	return token
+}
+
+// -------------------------
+func (_this *sessionLogger) Debugf(format string, args ...any) {
+	logAt(_this.logger, slog.LevelDebug, format, args...)
+}
+func (_this *sessionLogger) Infof(format string, args ...any) {
+	logAt(_this.logger, slog.LevelInfo, format, args...)
+}
+func (_this *sessionLogger) Warnf(format string, args ...any) {
+	logAt(_this.logger, slog.LevelWarn, format, args...)
+}
+func (_this *sessionLogger) Errorf(format string, args ...any) {
+	logAt(_this.logger, slog.LevelError, format, args...)
+}
+
+// -------------------------
+// rotatingFile 是依大小與時間輪替的日誌檔
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	lock       sync.Mutex
+	file       *os.File // 目前的日誌檔，輪替後無法開新檔時為 nil
+	size       int64
+	opened     time.Time
+	closed     bool
+}
+
+// -------------------------
+func openRotatingFile(path string, config LogConfig) (*rotatingFile, error) {
+	_this := &rotatingFile{path: path}
+	_this.configure(config)
+
+	if err := _this.open(); err != nil {
+		return nil, err
+	}
+	return _this, nil
+}
+
+// -------------------------
+// configure 套用輪替設定，未設定的項目使用預設值
+func (_this *rotatingFile) configure(config LogConfig) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	_this.maxSize = int64(defaultLogMaxSizeMB) << 20
+	_this.maxAge = defaultLogMaxAgeDays * 24 * time.Hour
+	_this.maxBackups = defaultLogMaxBackups
+	if config.MaxSizeMB > 0 {
+		_this.maxSize = int64(config.MaxSizeMB) << 20
+	}
+	if config.MaxAgeDays > 0 {
+		_this.maxAge = time.Duration(config.MaxAgeDays) * 24 * time.Hour
+	}
+	if config.MaxBackups > 0 {
+		_this.maxBackups = config.MaxBackups
+	}
+}
+
+// -------------------------
+func (_this *rotatingFile) open() error {
+	if _dir := filepath.Dir(_this.path); _dir != "" {
+		os.MkdirAll(_dir, 0755)
+	}
+	_file, err := os.OpenFile(_this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_this.file = _file
+	_this.size = 0
+	_this.opened = time.Now()
+	if _info, err := _file.Stat(); err == nil {
+		_this.size = _info.Size()
+		_this.opened = _info.ModTime()
+		if _this.size == 0 {
+			_this.opened = time.Now()
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// Write 寫入日誌，超過大小上限或檔案已開啟超過一天時先輪替
+func (_this *rotatingFile) Write(b []byte) (int, error) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	if _this.closed {
+		return 0, os.ErrClosed
+	}
+	if _this.file != nil && (_this.size+int64(len(b)) > _this.maxSize || time.Since(_this.opened) > 24*time.Hour) {
+		_this.rotate()
+	}
+	if _this.file == nil {
+		// 無法開新檔時改寫到 stdout 避免遺失日誌，下次寫入時再重試
+		if err := _this.open(); err != nil {
+			return os.Stdout.Write(b)
+		}
+	}
+
+	n, err := _this.file.Write(b)
+	_this.size += int64(n)
+	return n, err
+}
+
+// -------------------------
+// Close 關閉日誌檔
+func (_this *rotatingFile) Close() error {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	_this.closed = true
+	if _this.file == nil {
+		return nil
+	}
+	err := _this.file.Close()
+	_this.file = nil
+	return err
+}
+
+// -------------------------
+// rotate 將目前的日誌檔改名為 <path>.<時間>，並清除過期或過多的舊檔
+func (_this *rotatingFile) rotate() {
+	_this.file.Close()
+	_this.file = nil
+	os.Rename(_this.path, _this.backupPath(time.Now()))
+
+	// 開檔失敗時 file 維持 nil，由 Write 改寫到 stdout
+	_this.open()
+	_this.prune()
+}
+
+// -------------------------
+// backupPath 回傳不與既有備份重複的檔名，同一秒內輪替多次時加上序號 (依檔名排序即為新舊順序)
+func (_this *rotatingFile) backupPath(now time.Time) string {
+	_base := _this.path + "." + now.Format("20060102-150405")
+	_path := _base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(_path); err != nil {
+			return _path
+		}
+		_path = fmt.Sprintf("%s-%03d", _base, i)
+	}
+}
+
+// -------------------------
+func (_this *rotatingFile) prune() {
+	_backups, _ := filepath.Glob(_this.path + ".*")
+	sort.Sort(sort.Reverse(sort.StringSlice(_backups)))
+
+	for i, _backup := range _backups {
+		_info, err := os.Stat(_backup)
+		if err != nil {
+			continue
+		}
+		if i >= _this.maxBackups || time.Since(_info.ModTime()) > _this.maxAge {
+			os.Remove(_backup)
+		}
+	}
+}
@@ -3,11 +3,11 @@ package main
 //-------------------------
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -19,7 +19,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -29,7 +29,7 @@ import (
 // -------------------------
 func init() {
 	// 如果檢測到語係是 C，則強制改為 en-US 以避免 Fyne 報錯
-	fmt.Print("Check Env Lang\n")
+	fmt.Fprint(os.Stderr, "Check Env Lang\n")
 	if os.Getenv("LANG") == "C" || os.Getenv("LANG") == "" {
 		os.Setenv("LANG", "en-US.UTF-8")
 	}
@@ -41,135 +41,239 @@ const defaultAppName = "NetPassClient"
 const defaultHost = "https://netpass.mars-cloud.com"
 
 // -------------------------
+// config 與 profiles 在重新載入時整個替換，讀取端透過 currentConfig / runningProfiles 取得不會再變動的快照
 type GlobalData struct {
-	hwID   string
-	config Config
-	ui     *GUI
+	config   atomic.Pointer[Config]
+	ui       *GUI
+	profiles atomic.Pointer[[]*Profile] // 執行中的 profile，各自持有 ID 與 MQTT 連線
 }
 
 // -------------------------
 var Global GlobalData
 
 // -------------------------
-// HttpRequestPayload 定義了從 Broker 接收到的 MQTT 請求資料結構
-type HttpRequestPayload struct {
-	Action     string              `json:"action"`      // 動作 (空或 "tunnel")
-	Token      string              `json:"token"`       // 隧道識別碼
-	TargetPort string              `json:"target_port"` // 目標本地 Port
-	Method     string              `json:"method"`      // HTTP 方法
-	URL        string              `json:"url"`         // 包含路由資訊的路徑
-	Header     map[string][]string `json:"header"`      // 轉發的 Header
-	Body       string              `json:"body"`        // 請求主體
-	HardwareID string              `json:"hardware_id"` // 來源 Broker ID
-	SessionID  string              `json:"session_id"`  // 交易追蹤 ID
+// currentConfig 回傳目前的設定，尚未載入時回傳空的設定
+func currentConfig() *Config {
+	if _config := Global.config.Load(); _config != nil {
+		return _config
+	}
+	return &Config{}
 }
 
 // -------------------------
-// HttpResponsePayload 定義了要回傳給 Broker 的 MQTT 回應資料結構
-type HttpResponsePayload struct {
-	StatusCode int                 `json:"status_code"` // HTTP 狀態碼
-	Status     string              `json:"status"`      // 狀態描述
-	Header     map[string][]string `json:"header"`      // 本地端 Response Header
-	Body       string              `json:"body"`        // 本地端 Response Body
-	HardwareID string              `json:"hardware_id"` // 本機 Client ID
-	RequestURL string              `json:"request_url"` // 被呼叫的本地 URL
-	SessionID  string              `json:"session_id"`  // 對應請求的交易 ID
+// runningProfiles 回傳執行中的 profile 清單
+func runningProfiles() []*Profile {
+	if _profiles := Global.profiles.Load(); _profiles != nil {
+		return *_profiles
+	}
+	return nil
 }
 
 // -------------------------
-// getHardwareID 透過 MAC Address 產生唯一的 12 位元硬體識別碼
-func getHardwareID() string {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return ""
-	}
-
-	var hardwareData string
-	for _, i := range interfaces {
-		if i.HardwareAddr.String() != "" {
-			hardwareData += i.HardwareAddr.String()
-		}
-	}
+// configPath 是設定檔路徑，由 locateConfig 決定，預設為工作目錄下的 config.json
+var configPath = "config.json"
 
-	if hardwareData == "" {
-		return ""
-	}
+// -------------------------
+// HttpRequestPayload 定義了從 Broker 接收到的 MQTT 請求資料結構
+type HttpRequestPayload struct {
+	Action       string              `json:"action"`             // 動作 (空、"tunnel"、"tcp_tunnel"、"http_tunnel" 或 "body")
+	Token        string              `json:"token"`              // 隧道識別碼
+	TargetPort   string              `json:"target_port"`        // 目標本地 Port
+	TargetHost   string              `json:"target_host"`        // 目標區網主機 (targets 名稱或 host，空值為 localhost)
+	Method       string              `json:"method"`             // HTTP 方法
+	URL          string              `json:"url"`                // 包含路由資訊的路徑
+	Header       map[string][]string `json:"header"`             // 轉發的 Header
+	Body         string              `json:"body"`               // 請求主體
+	BodyEncoding string              `json:"body_encoding"`      // 請求主體編碼 ("base64" 代表二進位內容)
+	HardwareID   string              `json:"hardware_id"`        // 來源 Broker ID
+	SessionID    string              `json:"session_id"`         // 交易追蹤 ID
+	Chunked      bool                `json:"chunked,omitempty"`  // 請求主體是否分段傳送 (後續分段的 action 為 "body")
+	Seq          int                 `json:"seq,omitempty"`      // 分段序號，第一段 (含 Method 與 Header) 為 0
+	Final        bool                `json:"final,omitempty"`    // 是否為最後一段
+	Deadline     int64               `json:"deadline,omitempty"` // 公開端呼叫者放棄等待的時間 (Unix 毫秒)，超過時取消本地請求
+}
 
-	hash := sha256.Sum256([]byte(hardwareData))
-	return hex.EncodeToString(hash[:])[:12]
+// -------------------------
+// HttpResponsePayload 定義了要回傳給 Broker 的 MQTT 回應資料結構
+type HttpResponsePayload struct {
+	StatusCode int                 `json:"status_code"`       // HTTP 狀態碼
+	Status     string              `json:"status"`            // 狀態描述
+	Header     map[string][]string `json:"header"`            // 本地端 Response Header
+	Body       string              `json:"body"`              // 本地端 Response Body
+	HardwareID string              `json:"hardware_id"`       // 本機 Client ID
+	RequestURL string              `json:"request_url"`       // 被呼叫的本地 URL
+	SessionID  string              `json:"session_id"`        // 對應請求的交易 ID
+	Chunked    bool                `json:"chunked,omitempty"` // 是否為分段回應 (依 SessionID 與 Seq 組合)
+	Seq        int                 `json:"seq,omitempty"`     // 分段序號，第一段 (含狀態與 Header) 為 0
+	Final      bool                `json:"final,omitempty"`   // 是否為最後一段
 }
 
 // -------------------------
-// messagePubHandler 是處理 MQTT 訊息的核心函式
-var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+// onMessage 是處理 MQTT 訊息的核心函式
+func (_this *Profile) onMessage(client mqtt.Client, msg mqtt.Message) {
 	var payload HttpRequestPayload
 	err := json.Unmarshal(msg.Payload(), &payload)
 	if err != nil {
-		fmt.Printf("[RAW] Received: %s\n", msg.Payload())
+		logDebugf("[RAW] Received: %s", msg.Payload())
 		return
 	}
 
+	// 重新啟動或關閉中，拒絕新的請求 (分段上傳的後續內容仍繼續接收)
+	if isDraining() && payload.Action != "body" {
+		_this.sessionLog(payload.SessionID).Warnf("Rejected %s request: %v", payload.Action, errDraining)
+		metricRejected.Inc(payload.Action, "draining")
+		queueReject(func() { _this.rejectRequest(payload, http.StatusServiceUnavailable, errDraining) })
+		return
+	}
+
+	// 以下請求交給各類型的工作池執行，名額與佇列用完時回應 429 (隧道則以 Close Code 關閉)
+
 	// 處理隧道請求 (WebSocket)
 	if payload.Action == "tunnel" {
-		go handleTunnel(payload)
+		_this.dispatch(kindWebSocket, payload, func() { _this.handleTunnel(payload) }, nil)
 		return
 	}
 
 	// 處理 TCP 隧道請求 (例如 SSH, RDP)
 	if payload.Action == "tcp_tunnel" {
-		go handleTCPTunnel(payload)
+		_this.dispatch(kindTCP, payload, func() { _this.handleTCPTunnel(payload) }, nil)
+		return
+	}
+
+	// 處理以 WSS 隧道轉送的原始 HTTP 請求
+	if payload.Action == "http_tunnel" {
+		_this.dispatch(kindHTTPTunnel, payload, func() { _this.handleHTTPTunnel(payload) }, nil)
+		return
+	}
+
+	// 處理分段上傳的後續內容
+	if payload.Action == "body" {
+		_this.feedUpload(payload)
+		return
+	}
+
+	// 分段上傳需先建立 Session，在佇列中等待時才能繼續接收後續的分段
+	if payload.Chunked && !payload.Final {
+		_upload := _this.startUpload(payload)
+		_this.dispatch(kindHTTP, payload, func() { _this.handleHTTPRequest(payload, _upload) }, func() { _upload.abort(errUploadAborted) })
+		return
+	}
+
+	_this.dispatch(kindHTTP, payload, func() { _this.handleHTTPRequest(payload, nil) }, nil)
+}
+
+// -------------------------
+// handleHTTPRequest 將一般 HTTP 請求轉發至本地服務，並將結果發布回 MQTT
+// upload 不為 nil 時，請求主體由分段上傳的 Session 提供
+func (_this *Profile) handleHTTPRequest(payload HttpRequestPayload, upload *uploadSession) {
+	_log := _this.sessionLog(payload.SessionID)
+	if upload != nil {
+		defer upload.abort(errUploadAborted)
+	}
+
+	// 檢查目標主機與 Port 是否開放給 HTTP 流量
+	host, port, err := _this.resolveTarget(payload, kindHTTP)
+	if err != nil {
+		_log.Warnf("[Policy] Rejected HTTP request to %s:%s: %v", payload.TargetHost, payload.TargetPort, err)
+		recordRequest(_this.settings().ID, kindHTTP, payload.SessionID, payload.TargetHost+":"+payload.TargetPort, err.Error(), http.StatusForbidden, time.Now())
+		metricRejected.Inc(kindHTTP, "policy")
+		_this.publishResponse(HttpResponsePayload{
+			StatusCode: http.StatusForbidden,
+			Status:     "403 Forbidden: " + err.Error(),
+			HardwareID: _this.assignedID(),
+			SessionID:  payload.SessionID,
+		})
 		return
 	}
 
+	// 還原請求主體，分段上傳時改由 Pipe 逐段讀取
+	var _body *trackedReader
+	if upload != nil {
+		_body = &trackedReader{Reader: upload.reader}
+	} else {
+		_data, err := decodeBody(payload.Body, isBase64Body(payload))
+		if err != nil {
+			_log.Warnf("Rejected request body: %v", err)
+			_this.publishResponse(HttpResponsePayload{
+				StatusCode: http.StatusBadRequest,
+				Status:     "400 Bad Request: " + err.Error(),
+				HardwareID: _this.assignedID(),
+				SessionID:  payload.SessionID,
+			})
+			return
+		}
+		_body = &trackedReader{Reader: bytes.NewReader(_data)}
+	}
+
 	// 1. 解析與顯示請求資訊
 	//pretty, _ := json.MarshalIndent(payload, "", "  ")
 	//fmt.Printf("--------------------------------------------------\n")
 	//fmt.Printf("Received HTTP Request via MQTT [%s]:\n%s\n", msg.Topic(), string(pretty))
 
-	// 2. 使用傳來的 Port 與 Path
-	port := payload.TargetPort
+	// 2. 使用解析後的主機、Port 與傳來的 Path
+	address := net.JoinHostPort(host, port)
 	targetPath := payload.URL
 
-	localURL := fmt.Sprintf("http://localhost:%s%s", port, targetPath)
+	// 設定為或已知為 HTTPS 的服務直接以 HTTPS 連線，省去每次先嘗試 HTTP 的往返
+	_scheme := "http"
+	if _useTLS, ok := localTLSAddrs.Load(address); (ok && _useTLS.(bool)) || currentConfig().LocalHTTP.usesHTTPS(port) {
+		_scheme = "https"
+	}
+	localURL := fmt.Sprintf("%s://%s%s", _scheme, address, targetPath)
 	//fmt.Printf("Proxying to local : %s %s\n", payload.Method, localURL)
 
 	// 3. 建立並執行本地 HTTP 請求
-	req, err := http.NewRequest(payload.Method, localURL, bytes.NewBufferString(payload.Body))
-	if err != nil {
-		fmt.Printf("Failed to create request : %v\n", err)
-		return
+	_started := time.Now()
+	_timeouts := currentConfig().Timeouts.forPort(port)
+
+	// 連線與 Header 逾時由 Transport 控制，整體逾時由 _timer 控制，串流回應開始後即停止計時
+	// 分段上傳的主體可能需要很久才傳完，整體逾時在主體接收完畢後才開始計算
+	// 請求帶有 deadline 時，公開端的呼叫者放棄等待後 (包含串流期間) 立即取消本地請求
+	_ctx, _cancel := context.WithCancelCause(context.Background())
+	_timer := &requestTimer{total: _timeouts.total, cancel: _cancel}
+	_stopTimer := _timer.stop
+	if upload != nil {
+		_body.onEOF = _timer.start
+	} else {
+		_timer.start()
 	}
-
-	// 複製與清洗 Header
-	for k, vv := range payload.Header {
-		_kl := strings.ToLower(k)
-		if _kl == "host" {
-			continue
-		}
-		for _, v := range vv {
-			req.Header.Add(k, v)
-		}
+	_stopDeadline := func() bool { return true }
+	if payload.Deadline > 0 {
+		_stopDeadline = time.AfterFunc(time.Until(time.UnixMilli(payload.Deadline)), func() { _cancel(errCallerDeadline) }).Stop
+	}
+	_end := trackSession(_this.settings().ID, kindHTTP, payload.SessionID, address, payload, func() { _cancel(nil) })
+	_cleanup := func() {
+		_stopDeadline()
+		_cancel(nil)
+		_end()
 	}
 
-	// 強制設定 Host 為 localhost，避免被 Web Server 拒絕
-	req.Host = "localhost"
+	req, err := newLocalRequest(_ctx, payload, localURL, host, _body)
+	if err != nil {
+		_log.Errorf("Failed to create request : %v", err)
+		_stopTimer()
+		_cleanup()
+		_this.publishResponse(HttpResponsePayload{
+			StatusCode: http.StatusBadGateway,
+			Status:     "502 Bad Gateway: " + err.Error(),
+			HardwareID: _this.assignedID(),
+			SessionID:  payload.SessionID,
+		})
+		return
+	}
 
 	// 執行本地端 API 呼叫
-	// 設定支援 Insecure TLS 的 Client
-	httpClient := &http.Client{
-		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
+	// 同一目標共用 Transport，連線可重用於後續請求 (支援 Insecure TLS 與 HTTP/2)
+	httpClient := &http.Client{Transport: localTransport(address, port)}
 
 	// 嘗試 HTTP 呼叫
 	resp, err := httpClient.Do(req)
 
 	// 如果 HTTP 失敗，嘗試切換為 HTTPS
 	// 增加偵測 "EOF" 錯誤
+	// 請求主體已被讀取時無法重送，不做切換
 	_isHTTPSOnly := false
-	if err != nil {
+	if err != nil && !_body.used && _scheme == "http" {
 		_errStr := err.Error()
 		if strings.Contains(_errStr, "EOF") ||
 			strings.Contains(_errStr, "connection refused") ||
@@ -180,246 +284,268 @@ var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 	}
 
 	if _isHTTPSOnly {
-		localURL = fmt.Sprintf("https://localhost:%s%s", port, targetPath)
-		req, _ = http.NewRequest(payload.Method, localURL, bytes.NewBufferString(payload.Body))
-
-		// 重新設定清洗後的 Header
-		for k, vv := range payload.Header {
-			_kl := strings.ToLower(k)
-			if _kl == "host" {
-				continue
-			}
-			for _, v := range vv {
-				req.Header.Add(k, v)
-			}
+		metricHTTPSFallbacks.Inc(kindHTTP)
+		localURL = fmt.Sprintf("https://%s%s", address, targetPath)
+		if upload == nil {
+			_body.Reader.(*bytes.Reader).Seek(0, io.SeekStart)
 		}
-		req.Host = "localhost"
+		req, _ = newLocalRequest(_ctx, payload, localURL, host, _body)
 
 		resp, err = httpClient.Do(req)
 	}
 
+	// 記住服務的協定，連線失敗時重新偵測
+	// 本地服務未讀完上傳的主體就先回應時，從收到回應起計算整體逾時
+	if err == nil {
+		_timer.start()
+		localTLSAddrs.Store(address, req.URL.Scheme == "https")
+	} else {
+		localTLSAddrs.Delete(address)
+	}
+
+	// 記錄請求結果 (串流回應以收到 Header 的時間計算)
+	_status := http.StatusBadGateway
+	if err == nil {
+		_status = resp.StatusCode
+	} else {
+		err, _status = localRequestError(_ctx, err)
+	}
+	// 上傳的內容超過暫存上限而中止時，以 429 通知伺服器稍後重試
+	if upload != nil && upload.failure() == errUploadOverflow {
+		err, _status = errUploadOverflow, http.StatusTooManyRequests
+	}
+	recordRequest(_this.settings().ID, kindHTTP, payload.SessionID, address, payload.Method+" "+targetPath, _status, _started)
+	metricHTTPRequests.Inc(port, payload.Method, strconv.Itoa(_status))
+	metricHTTPDuration.Observe(time.Since(_started).Seconds(), port, payload.Method)
+
 	// 準備回傳資料
 	var responsePayload HttpResponsePayload
-	responsePayload.HardwareID = Global.hwID
+	responsePayload.HardwareID = _this.assignedID()
 	responsePayload.RequestURL = localURL
 	responsePayload.SessionID = payload.SessionID // 關鍵：帶回 session_id 供伺服器配對
 
 	if err != nil {
-		fmt.Printf("Local request failed : %v\n", err)
+		_log.Errorf("Local request failed : %v", err)
 		responsePayload.Status = "Error: " + err.Error()
-		responsePayload.StatusCode = 502
+		responsePayload.StatusCode = _status
 	} else {
-		defer resp.Body.Close()
-		respBody, err := io.ReadAll(resp.Body)
+		// 判斷是否為文字類資料
+		contentType := resp.Header.Get("Content-Type")
+		isText := strings.Contains(contentType, "text") ||
+			strings.Contains(contentType, "json") ||
+			strings.Contains(contentType, "javascript") ||
+			strings.Contains(contentType, "xml") ||
+			strings.Contains(contentType, "html")
+
+		responsePayload.Status = resp.Status
+		responsePayload.StatusCode = resp.StatusCode
+		responsePayload.Header = resp.Header
+
+		// Server-Sent Events 等長時間回應直接進入串流模式
+		// 串流在目前的 worker 中執行，串流期間仍佔用工作池的名額
+		if strings.Contains(contentType, "text/event-stream") {
+			_stopTimer()
+			_this.streamResponse(responsePayload, resp.Body, true, _cleanup)
+			return
+		}
+
+		// 先讀取至門檻值，超過時改以分段串流回傳剩餘內容
+		_threshold := currentConfig().streamThreshold()
+		respBody, err := io.ReadAll(io.LimitReader(resp.Body, _threshold+1))
 		if err != nil {
-			fmt.Printf("Failed to read response body: %v\n", err)
+			err, responsePayload.StatusCode = localRequestError(_ctx, err)
+			_log.Errorf("Failed to read response body: %v", err)
 			responsePayload.Status = "Error reading response"
-			responsePayload.StatusCode = 502
+			responsePayload.Header = nil
+		} else if int64(len(respBody)) > _threshold {
+			_stopTimer()
+			_stream := readCloser{io.MultiReader(bytes.NewReader(respBody), resp.Body), resp.Body}
+			_this.streamResponse(responsePayload, _stream, false, _cleanup)
+			return
+		} else if !isText && len(respBody) > 0 {
+			// 非文字類資料，轉為 Base64
+			responsePayload.Body = base64.StdEncoding.EncodeToString(respBody)
+			// 在 Header 中註明 Base64 格式
+			markBase64(responsePayload.Header, contentType)
 		} else {
-			// 判斷是否為文字類資料
-			contentType := resp.Header.Get("Content-Type")
-			isText := strings.Contains(contentType, "text") ||
-				strings.Contains(contentType, "json") ||
-				strings.Contains(contentType, "javascript") ||
-				strings.Contains(contentType, "xml") ||
-				strings.Contains(contentType, "html")
-
-			responsePayload.Status = resp.Status
-			responsePayload.StatusCode = resp.StatusCode
-			responsePayload.Header = resp.Header
-
-			if !isText && len(respBody) > 0 {
-				// 非文字類資料，轉為 Base64
-				responsePayload.Body = base64.StdEncoding.EncodeToString(respBody)
-				// 在 Header 中註明 Base64 格式
-				responsePayload.Header["Content-Transfer-Encoding"] = []string{"base64"}
-				if contentType != "" {
-					responsePayload.Header["Content-Type"] = []string{contentType + "; base64"}
-				}
-			} else {
-				responsePayload.Body = string(respBody)
-			}
+			responsePayload.Body = string(respBody)
 		}
+		resp.Body.Close()
 	}
+	_stopTimer()
+	_cleanup()
 
 	// 4. 將執行結果發布回 MQTT (使用 http/response 前綴)
-	responseTopic := fmt.Sprintf("http/response/%s", Global.hwID)
+	_this.publishResponse(responsePayload)
+
+	//fmt.Printf("Published response with SessionID: %s\n", payload.SessionID)
+}
+
+// -------------------------
+// newLocalRequest 建立轉發至本地服務的請求並複製清洗後的 Header
+func newLocalRequest(ctx context.Context, payload HttpRequestPayload, localURL string, host string, body *trackedReader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, payload.Method, localURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	_isBase64 := isBase64Body(payload)
+
+	// 複製與清洗 Header
+	for k, vv := range payload.Header {
+		_kl := strings.ToLower(k)
+		if _kl == "host" || _kl == "content-length" {
+			continue
+		}
+		// Base64 標記只用於 MQTT 傳輸，不轉發給本地服務
+		if _isBase64 && _kl == "content-transfer-encoding" {
+			continue
+		}
+		for _, v := range vv {
+			if _isBase64 && _kl == "content-type" {
+				v = strings.TrimSuffix(v, "; base64")
+			}
+			req.Header.Add(k, v)
+		}
+	}
+
+	// 一般請求的長度由解碼後的內容決定，分段上傳則沿用原本的 Content-Length
+	if _reader, ok := body.Reader.(*bytes.Reader); ok {
+		req.ContentLength = int64(_reader.Len())
+	} else if _length, err := strconv.ParseInt(http.Header(payload.Header).Get("Content-Length"), 10, 64); err == nil {
+		req.ContentLength = _length
+	} else {
+		req.ContentLength = -1
+	}
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	} else if _reader, ok := body.Reader.(*bytes.Reader); ok {
+		// 重用的連線已被本地服務關閉時，讓 Transport 可以重送請求主體
+		req.GetBody = func() (io.ReadCloser, error) {
+			_reader.Seek(0, io.SeekStart)
+			return io.NopCloser(body), nil
+		}
+	}
+
+	// 強制設定 Host 為目標主機，避免被 Web Server 拒絕
+	req.Host = host
+
+	return req, nil
+}
+
+// -------------------------
+// publishResponse 將回應發布到 http/response/<hwID> 主題
+func (_this *Profile) publishResponse(responsePayload HttpResponsePayload) {
+	responseTopic := fmt.Sprintf("http/response/%s", _this.assignedID())
 	jsonResp, err := json.Marshal(responsePayload)
 	if err != nil {
-		fmt.Printf("Failed to marshal response: %v\n", err)
+		_this.log().Errorf("Failed to marshal response: %v", err)
+		return
+	}
+	_client := _this.mqttClient()
+	if _client == nil {
 		return
 	}
-	token := client.Publish(responseTopic, 1, false, jsonResp)
+	token := _client.Publish(responseTopic, 1, false, jsonResp)
 	token.Wait()
-
-	//fmt.Printf("Published response with SessionID: %s\n", payload.SessionID)
 }
 
 // -------------------------
-// connectHandler 連線成功時觸發
-var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	fmt.Println("Connected to NetPass Tunnel")
+// onConnect 連線成功時觸發
+func (_this *Profile) onConnect(client mqtt.Client) {
+	_log := _this.log()
+	_log.Infof("Connected to NetPass Tunnel")
 
 	// 顯示公網存取網址
-	_host := strings.TrimSuffix(Global.config.Host, "/")
-	fmt.Printf("Public access URL: %s/pass/%s/\n", _host, Global.hwID)
+	_log.Infof("Public access URL: %s", _this.publicURL())
 
 	// 訂閱專屬於此硬體 ID 的請求主題 (配合 MarsCloud 規則)
-	topic := fmt.Sprintf("http/request/%s", Global.hwID)
-	fmt.Printf("Subscribing to topic: %s...\n", topic)
+	topic := fmt.Sprintf("http/request/%s", _this.assignedID())
+	_log.Infof("Subscribing to topic: %s...", topic)
 
 	// 使用非同步方式訂閱，並設定超時，避免卡死連線執行緒
 	go func() {
 		token := client.Subscribe(topic, 1, nil)
 		if token.WaitTimeout(10 * time.Second) {
 			if token.Error() != nil {
-				fmt.Printf("Subscribe failed: %v\n", token.Error())
+				_log.Errorf("Subscribe failed: %v", token.Error())
 			} else {
-				fmt.Printf("Subscribed to topic: %s\n", topic)
+				_log.Infof("Subscribed to topic: %s", topic)
+				_this.publishStatus(client, statusOnline, "")
+				confirmUpdate()
 				//sysTray.SetStatus("Connected")
 			}
 		} else {
-			fmt.Println("Subscribe timed out. Will retry automatically by library or next connect.")
+			_log.Warnf("Subscribe timed out. Will retry automatically by library or next connect.")
 			//sysTray.SetStatus("Create tunnel FAIL")
 		}
 	}()
 }
 
 // -------------------------
-var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	fmt.Printf("Connect lost: %v. Waiting for auto-reconnect...\n", err)
+// onConnectionLost 連線中斷時觸發，由 paho 自動重新連線
+func (_this *Profile) onConnectionLost(client mqtt.Client, err error) {
+	_this.log().Warnf("Connect lost: %v. Waiting for auto-reconnect...", err)
+	metricMQTTReconnects.Inc(_this.settings().ID)
 	//sysTray.SetStatus("Disconnect")
 }
 
-// -------------------------
-// checkUpdate 檢查並執行自動更新
-func checkUpdate() {
-	_execPath, _err := os.Executable()
-	if _err != nil {
-		return
-	}
-
-	// 檢查是否為 go run 模式 (源碼執行)
-	if strings.Contains(_execPath, "go-build") || strings.Contains(_execPath, "/tmp/") {
-		fmt.Println("Source code execution (go run) detected. Skipping auto-update.")
-		return
-	}
-
-	fmt.Println("Checking for updates...")
-	_os := runtime.GOOS
-	_arch := runtime.GOARCH
-
-	_updateURL := fmt.Sprintf("%s/update/%s/%s", strings.TrimSuffix(Global.config.Host, "/"), _os, _arch)
-
-	_client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
-	}
-
-	_resp, err := _client.Get(_updateURL)
-	if err != nil {
-		fmt.Printf("Update check failed: %v\n", err)
-		return
-	}
-	defer _resp.Body.Close()
-
-	if _resp.StatusCode != http.StatusOK {
-		// fmt.Printf("No update available or server error (%d)\n", _resp.StatusCode)
-		return
-	}
-
-	// 這裡簡單用 Content-Length 或 ETag 判斷是否需要更新
-	_fInfo, err := os.Stat(_execPath)
-	if err == nil {
-		// fmt.Printf("Current size: %d, Remote size: %d\n", _fInfo.Size(), _resp.ContentLength)
-		if _fInfo.Size() == _resp.ContentLength {
-			fmt.Println("Already up to date.")
-			return
-		}
-	}
-
-	// 下載到臨時檔案
-	_tmpPath := _execPath + ".tmp"
-	_out, err := os.Create(_tmpPath)
-	if err != nil {
-		fmt.Printf("Failed to create temp file: %v\n", err)
-		return
-	}
-
-	_, err = io.Copy(_out, _resp.Body)
-	_out.Close()
-	if err != nil {
-		fmt.Printf("Download failed: %v\n", err)
-		os.Remove(_tmpPath) // 清理臨時檔案
-		return
-	}
-
-	// 替換執行檔
-	err = os.Chmod(_tmpPath, 0755)
-	if err != nil {
-		fmt.Printf("Failed to set permissions: %v\n", err)
-		os.Remove(_tmpPath) // 清理臨時檔案
-		return
-	}
-
-	err = os.Rename(_tmpPath, _execPath)
-	if err != nil {
-		fmt.Printf("Failed to replace executable: %v\n", err)
-		os.Remove(_tmpPath) // 清理臨時檔案
-		return
-	}
-
-	fmt.Println("Update downloaded. Restarting...")
-	os.Exit(0)
-}
-
 // -------------------------
 // Config 定義設定檔結構
 type Config struct {
-	ApiKey     string `json:"api_key"`
-	Host       string `json:"host"`
-	Name       string `json:"name"`
-	AutoUpdate bool   `json:"auto_update"`
-}
-
-// -------------------------
-// loadConfig 從 config.json 載入設定
-func loadConfig() {
-
-	_file, err := os.Open("config.json")
-	if err != nil {
-		// 設定預設值
-		if Global.config.Host == "" {
-			Global.config.Host = defaultHost
-		}
-		return
-	}
-	defer _file.Close()
-
-	decoder := json.NewDecoder(_file)
-	err = decoder.Decode(&Global.config)
-	if err != nil {
-		fmt.Printf("Error decoding config.json: %v\n", err)
-	}
-
-	// 設定預設值
-	if Global.config.Host == "" {
-		Global.config.Host = defaultHost
-	}
+	ApiKey          string           `json:"api_key"`
+	AuthMode        string           `json:"auth_mode"` // 裝置認證方式：api_key (預設) / keypair (以裝置金鑰簽署 Challenge 並使用短效 Token)
+	Host            string           `json:"host"`
+	Name            string           `json:"name"`
+	AutoUpdate      bool             `json:"auto_update"`
+	UpdatePublicKey string           `json:"update_public_key"` // 驗證更新簽章的 ed25519 公鑰 (Base64)
+	UpdateInterval  string           `json:"update_interval"`   // 背景檢查更新的間隔 (例如 "6h")，預設 24h
+	UpdateChannel   string           `json:"update_channel"`    // 更新頻道 (stable / beta)，預設 stable
+	TLS             *TLSConfig       `json:"tls"`               // 伺服器憑證驗證設定 (CA、Pin、Insecure) 與用戶端憑證
+	MQTT            *MQTTConfig      `json:"mqtt"`              // MQTT Broker 的帳號密碼
+	Ports           *PortPolicy      `json:"ports"`             // 對外開放的本地 Port，未設定時全部開放
+	Targets         []Target         `json:"targets"`           // 可轉發的區網主機，未設定時只轉發 localhost
+	StreamThreshold int64            `json:"stream_threshold"`  // 回應超過此大小 (bytes) 時改為分段回傳
+	StreamChunkSize int              `json:"stream_chunk_size"` // 每段回應的大小 (bytes)
+	Admin           AdminConfig      `json:"admin"`             // 本機管理 API
+	Metrics         MetricsConfig    `json:"metrics"`           // Prometheus 指標的獨立監聽位址
+	Log             LogConfig        `json:"log"`               // 日誌等級、格式與輪替設定
+	ShutdownGrace   string           `json:"shutdown_grace"`    // 關閉時等待進行中連線結束的時間 (例如 "30s")
+	Instance        string           `json:"instance"`          // 實例名稱，同一台主機執行多個 Client 時區分鎖定檔
+	OnConflict      string           `json:"on_conflict"`       // 同名實例已在執行時：replace (請它交接) / refuse (拒絕啟動)
+	IdentityFile    string           `json:"identity_file"`     // 裝置身分檔路徑，預設為設定檔目錄下的 identity.json
+	Timeouts        *TimeoutConfig   `json:"timeouts"`          // 轉發至本地服務的連線、Header 與整體逾時，可依 Port 覆寫
+	Workers         *WorkerConfig    `json:"workers"`           // 各類型請求的並行上限與等待佇列
+	LocalHTTP       *LocalHTTPConfig `json:"local_http"`        // 轉發至本地服務的連線重用與 HTTP/2 設定
+	Mux             bool             `json:"mux"`               // 以單一 WSS 連線多工傳輸所有 WebSocket 與 TCP 隧道
+	Profiles        []ProfileConfig  `json:"profiles"`          // 多組裝置身分，未設定時以最外層的 api_key、host、name 為單一 profile
 }
 
 // -------------------------
 // getAssignedID 向伺服器請求分配的連線 ID
-func getAssignedID(localHWID string) string {
-	_apiKey := Global.config.ApiKey
-	_name := strings.TrimSpace(Global.config.Name)
-	if _apiKey == "" {
-		_apiKey = os.Getenv("NETPASS_KEY") // 仍保留環境變數作為備援
+func (_this *Profile) getAssignedID(localHWID string) string {
+	_log := _this.log()
+	_config := _this.settings()
+	_apiKey := _config.ApiKey
+	_name := strings.TrimSpace(_config.Name)
+
+	if _config.authMode() == authModeKeypair {
+		_id, err := _this.authenticate(localHWID)
+		if err == nil {
+			return _id
+		}
+		_this.lock.Lock()
+		_this.token = ""
+		_this.lock.Unlock()
+		if _name != "" {
+			_log.Errorf("Keypair authentication failed for device name %q: %v", _name, err)
+			return ""
+		}
+		_log.Errorf("Keypair authentication failed: %v. Using local HWID.", err)
+		return localHWID
 	}
 
-	_url := fmt.Sprintf("%s/api/getID", strings.TrimSuffix(Global.config.Host, "/"))
+	_url := fmt.Sprintf("%s/api/getID", strings.TrimSuffix(_config.Host, "/"))
 
 	_form := url.Values{}
 	_form.Set("hwid", localHWID)
@@ -431,17 +557,17 @@ func getAssignedID(localHWID string) string {
 	_client := &http.Client{
 		Timeout: 10 * time.Second,
 		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSClientConfig: _this.serverTLSConfig(),
 		},
 	}
 
 	_resp, err := _client.Post(_url, "application/x-www-form-urlencoded", strings.NewReader(_form.Encode()))
 	if err != nil {
 		if _name != "" {
-			fmt.Printf("Failed to register device name %q via %s: %v\n", _name, _url, err)
+			_log.Errorf("Failed to register device name %q via %s: %v", _name, _url, err)
 			return ""
 		}
-		fmt.Printf("Failed to get assigned ID from server: %v. Using local HWID.\n", err)
+		_log.Errorf("Failed to get assigned ID from server: %v. Using local HWID.", err)
 		return localHWID
 	}
 	defer _resp.Body.Close()
@@ -453,26 +579,26 @@ func getAssignedID(localHWID string) string {
 			_msg = http.StatusText(_resp.StatusCode)
 		}
 		if _resp.StatusCode == http.StatusBadRequest || _resp.StatusCode == http.StatusConflict {
-			fmt.Printf("Device registration failed (%d): %s\n", _resp.StatusCode, _msg)
+			_log.Errorf("Device registration failed (%d): %s", _resp.StatusCode, _msg)
 			return ""
 		}
 		if _name != "" {
-			fmt.Printf("Device registration failed (%d) via %s: %s\n", _resp.StatusCode, _url, _msg)
+			_log.Errorf("Device registration failed (%d) via %s: %s", _resp.StatusCode, _url, _msg)
 			return ""
 		}
-		fmt.Printf("Server returned error when assigning ID (%d): %s. Using local HWID.\n", _resp.StatusCode, _msg)
+		_log.Errorf("Server returned error when assigning ID (%d): %s. Using local HWID.", _resp.StatusCode, _msg)
 		return localHWID
 	}
 
 	_body, err := io.ReadAll(_resp.Body)
 	if err != nil {
-		fmt.Printf("Failed to read assigned ID: %v\n", err)
+		_log.Errorf("Failed to read assigned ID: %v", err)
 		return localHWID
 	}
 
 	_assignedID := strings.TrimSpace(string(_body))
 	if _assignedID == "" {
-		fmt.Println("Server returned empty ID. Using local HWID.")
+		_log.Warnf("Server returned empty ID. Using local HWID.")
 		return localHWID
 	}
 
@@ -481,43 +607,34 @@ func getAssignedID(localHWID string) string {
 
 // -------------------------
 // handleTunnel 建立與伺服器的 WSS 隧道並對接本地服務 (WebSocket 訊息中轉模式)
-func handleTunnel(payload HttpRequestPayload) {
-	// 1. 解析目標伺服器位址 (從 config.Host 提取 domain)
-	_domain := Global.config.Host
-	_domain = strings.TrimPrefix(_domain, "https://")
-	_domain = strings.TrimPrefix(_domain, "http://")
-
-	// 如果帶有路徑，先去掉路徑
-	if _idx := strings.Index(_domain, "/"); _idx != -1 {
-		_domain = _domain[:_idx]
-	}
+func (_this *Profile) handleTunnel(payload HttpRequestPayload) {
+	_log := _this.tunnelLog(payload.Token)
 
-	// 分離 Host 與 Port，只取 Host
-	_hostOnly := _domain
-	if _idx := strings.Index(_domain, ":"); _idx != -1 {
-		_hostOnly = _domain[:_idx]
+	// 1. 檢查目標主機與 Port 是否開放給 WebSocket 流量
+	_host, _port, err := _this.resolveTarget(payload, kindWebSocket)
+	if err != nil {
+		_log.Warnf("[Policy] Rejected WebSocket tunnel to %s:%s: %v", payload.TargetHost, payload.TargetPort, err)
+		recordRequest(_this.settings().ID, kindWebSocket, payload.Token, payload.TargetHost+":"+payload.TargetPort, err.Error(), http.StatusForbidden, time.Now())
+		metricRejected.Inc(kindWebSocket, "policy")
+		_this.rejectTunnel(payload, websocket.ClosePolicyViolation, "403 Forbidden: "+err.Error())
+		return
 	}
 
-	// 2. 直接使用傳來的 Port 與 Path
-	_port := payload.TargetPort
+	// 2. 使用解析後的主機、Port 與傳來的 Path
+	_address := net.JoinHostPort(_host, _port)
 	_targetPath := payload.URL
 
 	// 3. 連線到伺服器的 WSS 隧道埠 (18884)
-	// 這裡必須使用 _hostOnly 避免出現 test.com:8080:18884 的錯誤
-	_tunnelURL := fmt.Sprintf("wss://%s:18884/tunnel?token=%s", _hostOnly, payload.Token)
-	_dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	_wsTunnel, _, err := _dialer.Dial(_tunnelURL, nil)
+	_wsTunnel, err := _this.openTunnel(payload.Token)
 	if err != nil {
-		fmt.Printf("[Tunnel] Connection failed: %v\n", err)
+		_log.Errorf("[Tunnel] Connection failed: %v", err)
 		return
 	}
 	defer _wsTunnel.Close()
 
 	// 4. 連線到本地 OpenClaw (WS)
-	_localURL := fmt.Sprintf("ws://localhost:%s%s", _port, _targetPath)
-	fmt.Printf("[Local] Connecting to %s\n", _localURL)
+	_localURL := fmt.Sprintf("ws://%s%s", _address, _targetPath)
+	_log.Infof("[Local] Connecting to %s", _localURL)
 
 	_header := make(http.Header)
 	for k, v := range payload.Header {
@@ -529,8 +646,11 @@ func handleTunnel(payload HttpRequestPayload) {
 	}
 
 	// 強制覆蓋 Origin 為本地，避免被 OpenClaw 拒絕
-	_header.Set("Origin", fmt.Sprintf("http://localhost:%s", _port))
+	_header.Set("Origin", fmt.Sprintf("http://%s", _address))
 
+	_dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
 	_wsLocal, _resp, err := _dialer.Dial(_localURL, _header)
 
 	// 如果 WS 失敗，嘗試 WSS
@@ -547,23 +667,32 @@ func handleTunnel(payload HttpRequestPayload) {
 	}
 
 	if _isWSSOnly {
-		_localURL = fmt.Sprintf("wss://localhost:%s%s", _port, _targetPath)
-		fmt.Printf("[Local] Fallback connecting to %s\n", _localURL)
-		_header.Set("Origin", fmt.Sprintf("https://localhost:%s", _port))
+		metricHTTPSFallbacks.Inc(kindWebSocket)
+		_localURL = fmt.Sprintf("wss://%s%s", _address, _targetPath)
+		_log.Infof("[Local] Fallback connecting to %s", _localURL)
+		_header.Set("Origin", fmt.Sprintf("https://%s", _address))
 		_wsLocal, _resp, err = _dialer.Dial(_localURL, _header)
 	}
 
 	if err != nil {
 		if _resp != nil {
 			_body, _ := io.ReadAll(_resp.Body)
-			fmt.Printf("[Local] Connection failed: %v, Status: %d, Body: %s\n", err, _resp.StatusCode, string(_body))
+			_log.Errorf("[Local] Connection failed: %v, Status: %d, Body: %s", err, _resp.StatusCode, string(_body))
 		} else {
-			fmt.Printf("[Local] Connection failed: %v\n", err)
+			_log.Errorf("[Local] Connection failed: %v", err)
 		}
 		return
 	}
 	defer _wsLocal.Close()
-	fmt.Printf("[Local] Connected successfully to %s\n", _localURL)
+	_log.Infof("[Local] Connected successfully to %s", _localURL)
+
+	_end := trackSession(_this.settings().ID, kindWebSocket, payload.Token, _address, payload, func() {
+		_wsTunnel.Close()
+		_wsLocal.Close()
+	})
+	defer _end()
+	defer recordRequest(_this.settings().ID, kindWebSocket, payload.Token, _address, _targetPath, 0, time.Now())
+	metricTunnelsOpened.Inc(kindWebSocket)
 
 	// 5. 雙向中轉 WebSocket 訊息
 	_errChan := make(chan error, 2)
@@ -576,6 +705,7 @@ func handleTunnel(payload HttpRequestPayload) {
 				_errChan <- err
 				return
 			}
+			metricTunnelBytes.Add(float64(len(data)), kindWebSocket, "to_server")
 			err = _wsTunnel.WriteMessage(mt, data)
 			if err != nil {
 				_errChan <- err
@@ -592,6 +722,7 @@ func handleTunnel(payload HttpRequestPayload) {
 				_errChan <- err
 				return
 			}
+			metricTunnelBytes.Add(float64(len(data)), kindWebSocket, "to_local")
 			err = _wsLocal.WriteMessage(mt, data)
 			if err != nil {
 				_errChan <- err
@@ -605,46 +736,45 @@ func handleTunnel(payload HttpRequestPayload) {
 
 // -------------------------
 // handleTCPTunnel 建立與伺服器的 WSS 隧道並對接本地純 TCP 服務 (如 SSH port 22)
-func handleTCPTunnel(payload HttpRequestPayload) {
-	// 1. 解析目標伺服器位址 (從 config.Host 提取 domain)
-	_domain := Global.config.Host
-	_domain = strings.TrimPrefix(_domain, "https://")
-	_domain = strings.TrimPrefix(_domain, "http://")
-
-	if _idx := strings.Index(_domain, "/"); _idx != -1 {
-		_domain = _domain[:_idx]
-	}
+func (_this *Profile) handleTCPTunnel(payload HttpRequestPayload) {
+	_log := _this.tunnelLog(payload.Token)
 
-	_hostOnly := _domain
-	if _idx := strings.Index(_domain, ":"); _idx != -1 {
-		_hostOnly = _domain[:_idx]
+	// 1. 檢查目標主機與 Port 是否開放給 TCP 流量
+	_host, _port, err := _this.resolveTarget(payload, kindTCP)
+	if err != nil {
+		_log.Warnf("[Policy] Rejected TCP tunnel to %s:%s: %v", payload.TargetHost, payload.TargetPort, err)
+		recordRequest(_this.settings().ID, kindTCP, payload.Token, payload.TargetHost+":"+payload.TargetPort, err.Error(), http.StatusForbidden, time.Now())
+		metricRejected.Inc(kindTCP, "policy")
+		_this.rejectTunnel(payload, websocket.ClosePolicyViolation, "403 Forbidden: "+err.Error())
+		return
 	}
 
-	// 2. 取出 Port (如 22)
-	_port := payload.TargetPort
-
 	// 3. 連線到伺服器的 WSS 隧道埠 (18884)
-	_tunnelURL := fmt.Sprintf("wss://%s:18884/tunnel?token=%s", _hostOnly, payload.Token)
-	_dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	_wsTunnel, _, err := _dialer.Dial(_tunnelURL, nil)
+	_wsTunnel, err := _this.openTunnel(payload.Token)
 	if err != nil {
-		fmt.Printf("[TCP Tunnel] Server connection failed: %v\n", err)
+		_log.Errorf("[TCP Tunnel] Server connection failed: %v", err)
 		return
 	}
 	defer _wsTunnel.Close()
-	fmt.Printf("[TCP Tunnel] Connected successfully to Server WSS: %s\n", _tunnelURL)
+	_log.Infof("[TCP Tunnel] Connected successfully to Server WSS for Port %s", _port)
 
-	// 4. 建立本地 TCP 連線
-	_localAddr := fmt.Sprintf("localhost:%s", _port)
-	_tcpLocal, err := net.Dial("tcp", _localAddr)
+	// 4. 建立本地 (或區網目標) TCP 連線
+	_localAddr := net.JoinHostPort(_host, _port)
+	_tcpLocal, err := currentConfig().Timeouts.forPort(_port).dialer().Dial("tcp", _localAddr)
 	if err != nil {
-		fmt.Printf("[TCP Tunnel] Local connection failed: %v\n", err)
+		_log.Errorf("[TCP Tunnel] Local connection failed: %v", err)
 		return
 	}
 	defer _tcpLocal.Close()
-	fmt.Printf("[TCP Tunnel] Connected successfully to Local TCP: %s\n", _localAddr)
+	_log.Infof("[TCP Tunnel] Connected successfully to Local TCP: %s", _localAddr)
+
+	_end := trackSession(_this.settings().ID, kindTCP, payload.Token, _localAddr, payload, func() {
+		_wsTunnel.Close()
+		_tcpLocal.Close()
+	})
+	defer _end()
+	defer recordRequest(_this.settings().ID, kindTCP, payload.Token, _localAddr, "", 0, time.Now())
+	metricTunnelsOpened.Inc(kindTCP)
 
 	// 5. 雙向中轉資料: WSS(Server) <-> TCP(Local)
 	_errChan := make(chan error, 2)
@@ -657,6 +787,7 @@ func handleTCPTunnel(payload HttpRequestPayload) {
 				_errChan <- err
 				return
 			}
+			metricTunnelBytes.Add(float64(len(data)), kindTCP, "to_local")
 			_, err = _tcpLocal.Write(data)
 			if err != nil {
 				_errChan <- err
@@ -672,11 +803,12 @@ func handleTCPTunnel(payload HttpRequestPayload) {
 			n, err := _tcpLocal.Read(buffer)
 			if err != nil {
 				if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
-					fmt.Printf("[TCP Tunnel] Local read error: %v\n", err)
+					_log.Errorf("[TCP Tunnel] Local read error: %v", err)
 				}
 				_errChan <- err
 				return
 			}
+			metricTunnelBytes.Add(float64(n), kindTCP, "to_server")
 			err = _wsTunnel.WriteMessage(websocket.BinaryMessage, buffer[:n])
 			if err != nil {
 				_errChan <- err
@@ -686,11 +818,61 @@ func handleTCPTunnel(payload HttpRequestPayload) {
 	}()
 
 	<-_errChan
-	fmt.Printf("[TCP Tunnel] Session closed for Port %s\n", _port)
+	_log.Infof("[TCP Tunnel] Session closed for Port %s", _port)
 }
 
 // -------------------------
-// wsNetConn 將 websocket.Conn 包裝成 net.Conn 的轉接器
+// getTunnelHost 從 profile 的 Host 提取不含 Port 與路徑的網域名稱
+func (_this *Profile) getTunnelHost() string {
+	_domain := _this.settings().Host
+	_domain = strings.TrimPrefix(_domain, "https://")
+	_domain = strings.TrimPrefix(_domain, "http://")
+
+	// 如果帶有路徑，先去掉路徑
+	if _idx := strings.Index(_domain, "/"); _idx != -1 {
+		_domain = _domain[:_idx]
+	}
+
+	// 分離 Host 與 Port，只取 Host
+	if _idx := strings.Index(_domain, ":"); _idx != -1 {
+		_domain = _domain[:_idx]
+	}
+
+	return _domain
+}
+
+// -------------------------
+// dialTunnel 連線到伺服器的 WSS 隧道埠 (18884)
+func (_this *Profile) dialTunnel(token string) (*websocket.Conn, error) {
+	// 這裡必須使用不含 Port 的 Host，避免出現 test.com:8080:18884 的錯誤
+	_tunnelURL := fmt.Sprintf("wss://%s:18884/tunnel?token=%s", _this.getTunnelHost(), url.QueryEscape(token))
+	_dialer := websocket.Dialer{
+		TLSClientConfig: _this.serverTLSConfig(),
+	}
+	_wsTunnel, _, err := _dialer.Dial(_tunnelURL, _this.tunnelHeader())
+	return _wsTunnel, err
+}
+
+// -------------------------
+// rejectTunnel 連上隧道後立即以指定的 Close Code 關閉，讓伺服器端不必等待逾時
+func (_this *Profile) rejectTunnel(payload HttpRequestPayload, code int, reason string) {
+	_tunnel, err := _this.openTunnel(payload.Token)
+	if err != nil {
+		return
+	}
+
+	switch _conn := _tunnel.(type) {
+	case *muxStream:
+		_conn.closeWith(code, reason)
+	case *websocket.Conn:
+		defer _conn.Close()
+		_msg := websocket.FormatCloseMessage(code, reason)
+		_conn.WriteControl(websocket.CloseMessage, _msg, time.Now().Add(5*time.Second))
+	}
+}
+
+// -------------------------
+// wsNetConn 將 websocket.Conn 包裝成 net.Conn 的轉接器，多工隧道以此讀寫 frame
 type wsNetConn struct {
 	Conn   *websocket.Conn
 	reader io.Reader
@@ -743,76 +925,36 @@ func (c *wsNetConn) SetReadDeadline(t time.Time) error  { return c.Conn.SetReadD
 func (c *wsNetConn) SetWriteDeadline(t time.Time) error { return c.Conn.SetWriteDeadline(t) }
 
 // -------------------------
-// killExistingInstances 搜尋並終止其他正在運作的 NetPassClient 進程
-func killExistingInstances() {
-	currentPid := os.Getpid()
-
-	// 使用 pgrep 搜尋包含 "NetPassClient" 的進程 ID
-	// -f: 搜尋完整命令行
-	out, err := exec.Command("pgrep", "-f", "NetPassClient").Output()
-	if err != nil {
-		return // 通常代表沒找到
-	}
-
-	pids := strings.Fields(string(out))
-	for _, pidStr := range pids {
-		pid, err := strconv.Atoi(pidStr)
-		if err != nil {
-			continue
-		}
-
-		// 排除目前進程
-		if pid == currentPid {
-			continue
-		}
-
-		// 取得進程並嘗試終止
-		process, err := os.FindProcess(pid)
-		if err == nil {
-			fmt.Printf("Detected another NetPassClient (PID: %d). Killing it...\n", pid)
-			process.Signal(syscall.SIGKILL)
-			// 給予一點時間釋放資源
-			time.Sleep(500 * time.Millisecond)
-		}
-	}
-}
-
-// -------------------------
-func initHWID() {
-
-	_localHWID := getHardwareID()
-	if _localHWID == "" {
-		fmt.Println("Failed to generate local hardware ID. Exiting...")
-		return
-	}
+func (_this *Profile) initHWID(hardwareID string) {
 
 	// 向伺服器領取分配的 ID (可能是固定的或隨日期變動的)
-	Global.hwID = getAssignedID(_localHWID)
+	_this.setAssignedID(_this.getAssignedID(_this.localHWID(hardwareID)))
 
-	_name := strings.TrimSpace(Global.config.Name)
+	_name := strings.TrimSpace(_this.settings().Name)
 	if _name == "" {
 		_name = "-"
 	}
 
-	fmt.Printf("NetPassClient starting with : %s/%s\n", Global.hwID, _name)
+	_this.log().Infof("NetPassClient starting with : %s/%s", _this.assignedID(), _name)
 }
 
 // -------------------------
-func createTunnel() {
+func (_this *Profile) createTunnel() {
+	_log := _this.log()
 
-	if Global.hwID == "" {
-		fmt.Println("No Hardware ID. Exiting...")
+	if _this.assignedID() == "" {
+		_log.Errorf("No Hardware ID. Exiting...")
 		return
 	}
 
 	// 向伺服器領取分配的 ID (可能是固定的或隨日期變動的)
-	var clientId = fmt.Sprintf("%s", Global.hwID)
+	var clientId = fmt.Sprintf("%s", _this.assignedID())
 
 	//sysTray.SetHwID(hwID)
 	//sysTray.SetStatus("Connecting")
 
 	// 解析 Host 取得網域名稱以用於 MQTT (預設 18883)
-	_domain := Global.config.Host
+	_domain := _this.settings().Host
 	_domain = strings.TrimPrefix(_domain, "https://")
 	_domain = strings.TrimPrefix(_domain, "http://")
 
@@ -825,18 +967,24 @@ func createTunnel() {
 	}
 
 	_broker := fmt.Sprintf("ssl://%s:18883", _domain)
-	fmt.Printf("Connecting to Tunnel: %s\n", _broker)
+	_log.Infof("Connecting to Tunnel: %s", _broker)
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(_broker)
 	opts.SetClientID(clientId)
-	opts.SetDefaultPublishHandler(messagePubHandler)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
+	opts.SetDefaultPublishHandler(_this.onMessage)
+	opts.OnConnect = _this.onConnect
+	opts.OnConnectionLost = _this.onConnectionLost
 
-	opts.SetTLSConfig(&tls.Config{
-		InsecureSkipVerify: true,
-	})
+	opts.SetTLSConfig(_this.serverTLSConfig())
+
+	// 以帳密登入 Broker，每次連線與重新連線前重新取得 (金鑰模式的 Token、密碼檔的內容都可能已更新)
+	if _this.settings().hasMQTTCredentials() {
+		opts.SetCredentialsProvider(_this.mqttCredentials)
+	}
+
+	// 非預期斷線時由 Broker 代為發布下線狀態
+	opts.SetBinaryWill(_this.statusTopic(), _this.statusMessage(statusOffline, "connection lost"), 1, true)
 
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
@@ -845,25 +993,35 @@ func createTunnel() {
 
 	// 設定連線中斷與重連的回呼
 	opts.OnReconnecting = func(client mqtt.Client, options *mqtt.ClientOptions) {
-		fmt.Println("Attempting to reconnect to NetPass Tunnel...")
+		_log.Infof("Attempting to reconnect to NetPass Tunnel...")
 	}
 
 	client := mqtt.NewClient(opts)
+	_this.lock.Lock()
+	_this.client = client
+	_this.lock.Unlock()
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		fmt.Printf("Initial connection failed: %v. Retrying in background...\n", token.Error())
+		_log.Errorf("Initial connection failed: %v. Retrying in background...", token.Error())
 	}
 
 	//sysTray.SetStatus("Connected")
 }
 
 // -------------------------
-func checkDaemon() {
+// reconnectTunnel 中斷目前的 MQTT 連線並重新建立
+func (_this *Profile) reconnectTunnel() {
+	if _client := _this.mqttClient(); _client != nil {
+		_client.Disconnect(250)
+	}
+	_this.createTunnel()
+}
 
-	isDaemon := flag.Bool("d", false, "run in background")
-	flag.Parse()
+// -------------------------
+func checkDaemon() {
 
 	// 2. 如果不是在背景模式，且不是 Windows (Windows 建議用編譯參數)
-	if !*isDaemon && runtime.GOOS != "windows" {
+	// 由 systemd、launchd 等服務管理員啟動，或在容器內以 PID 1 執行時不可再 fork，否則服務管理員或容器會以為程式已結束
+	if !cli.daemon && runtime.GOOS != "windows" && serviceManager() == "" && os.Getpid() != 1 {
 		args := append(os.Args[1:], "-d")
 		cmd := exec.Command(os.Args[0], args...)
 
@@ -872,12 +1030,15 @@ func checkDaemon() {
 		cmd.Stderr = nil
 		cmd.Stdin = nil
 
+		// 鎖定交給子進程持有
+		releaseInstanceLock()
+
 		err := cmd.Start()
 		if err != nil {
-			fmt.Printf("Cannot run as Daemon : %v\n", err)
+			logErrorf("Cannot run as Daemon : %v", err)
 		} else {
 
-			fmt.Printf("NetPassClient run as Daemon : %d\n", cmd.Process.Pid)
+			logInfof("NetPassClient run as Daemon : %d", cmd.Process.Pid)
 			time.Sleep(1 * time.Second)
 			os.Exit(0) // 結束父進程，釋放 Console
 		}
@@ -887,22 +1048,34 @@ func checkDaemon() {
 // -------------------------
 func main() {
 
-	// 啟動前先清理其他進程
-	killExistingInstances()
+	_opts, err := parseCLI(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stdout)
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	cli = _opts
 
-	// 載入設定檔
-	loadConfig()
-	initHWID()
+	os.Exit(runCommand(cli))
+}
 
-	// 啟動時檢查更新
-	if Global.config.AutoUpdate {
-		checkUpdate()
+// -------------------------
+// runClient 連線伺服器並處理請求，直到收到關閉訊號
+func runClient() {
+
+	prepareService()
+
+	// 由服務管理員啟動時沒有桌面，生命週期交給服務管理員
+	// 先進入服務管理員的控制流程再啟動 (Windows SCM 要求服務在 30 秒內回報)，等待實例鎖或檢查更新不會造成啟動逾時
+	if serviceManager() != "" {
+		runService(startClient)
+		return
 	}
 
-	go func() {
-		checkDaemon()
-		createTunnel()
-	}()
+	startClient()
 
 	Global.ui = createGUI()
 
@@ -913,4 +1086,52 @@ func main() {
 	}
 }
 
+// -------------------------
+// startClient 載入設定、取得實例鎖後連線伺服器，設定有誤或無法取得實例鎖時結束程式
+func startClient() {
+	// 更新後的啟動次數最先計算，新版在讀取設定時就結束也能被還原
+	checkPendingUpdate()
+
+	// 載入設定檔，設定有誤時直接結束，不以不完整的設定執行
+	if err := loadConfig(); err != nil {
+		logConfigError(err)
+		os.Exit(1)
+	}
+
+	// 背景模式的子進程沒有 Console，未設定日誌檔時預設寫入 client.log
+	initLogging(currentConfig().Log, cli.daemon)
+
+	// 同名實例只允許執行一個，依 on_conflict 拒絕啟動或請舊實例交接
+	if err := acquireInstanceLock(); err != nil {
+		logErrorf("%v. Exiting...", err)
+		os.Exit(1)
+	}
+
+	// 需要轉為背景執行時在此 fork 並結束父進程，更新的健康檢查、註冊與更新檢查只在子進程執行一次
+	checkDaemon()
+
+	watchPendingUpdate()
+	initHWID()
+
+	// 啟動時檢查更新，之後定期於背景檢查
+	if currentConfig().AutoUpdate {
+		checkUpdate()
+		startUpdateLoop()
+	}
+
+	handleSignals()
+
+	go func() {
+		startAdminServer()
+		startMetricsServer()
+		createTunnels()
+		watchConfig()
+		serviceReady()
+	}()
+
+	if _manager := serviceManager(); _manager != "" {
+		logInfof("Running under %s", _manager)
+	}
+}
+
 //-------------------------
@@ -0,0 +1,252 @@
+package main
+
+// -------------------------
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+// MetricsConfig 定義 Prometheus 指標的獨立監聽位址
+type MetricsConfig struct {
+	Listen string `json:"listen"` // 例如 0.0.0.0:9100，空值代表只透過管理 API 提供 /metrics
+}
+
+// -------------------------
+// metricVec 是帶標籤的 Counter / Gauge，以 Prometheus 文字格式輸出
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // counter / gauge
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// -------------------------
+// histogramVec 是帶標籤的 Histogram
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// -------------------------
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// -------------------------
+var (
+	metricHTTPRequests = newMetricVec("netpass_http_requests_total",
+		"Proxied HTTP requests by local port, method and status code.", "counter", "port", "method", "code")
+	metricHTTPDuration = newHistogramVec("netpass_http_request_duration_seconds",
+		"Time until the local service returned response headers.", []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "port", "method")
+	metricTunnelBytes = newMetricVec("netpass_tunnel_bytes_total",
+		"Bytes relayed through WebSocket and TCP tunnels.", "counter", "kind", "direction")
+	metricTunnelsOpened = newMetricVec("netpass_tunnels_opened_total",
+		"Tunnels opened by kind.", "counter", "kind")
+	metricMQTTReconnects = newMetricVec("netpass_mqtt_connection_lost_total",
+		"MQTT connection losses that triggered a reconnect.", "counter", "profile")
+	metricHTTPSFallbacks = newMetricVec("netpass_https_fallback_total",
+		"Requests retried over HTTPS/WSS after the plain attempt failed.", "counter", "kind")
+	metricRejected = newMetricVec("netpass_rejected_requests_total",
+		"Requests refused by policy or while shutting down.", "counter", "kind", "reason")
+	metricConfigReloads = newMetricVec("netpass_config_reloads_total",
+		"Configuration reloads by result (ok / error).", "counter", "result")
+	metricMuxConnects = newMetricVec("netpass_mux_connects_total",
+		"Multiplexed tunnel connections to the server by profile and result (ok / error).", "counter", "profile", "result")
+)
+
+// -------------------------
+func newMetricVec(name string, help string, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+// -------------------------
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+// -------------------------
+// Add 累加指定標籤組合的數值，標籤依建立時的順序傳入
+func (_this *metricVec) Add(value float64, labelValues ...string) {
+	_key := strings.Join(labelValues, "\xff")
+	_this.lock.Lock()
+	_this.values[_key] += value
+	_this.lock.Unlock()
+}
+
+// -------------------------
+// Inc 將指定標籤組合加一
+func (_this *metricVec) Inc(labelValues ...string) {
+	_this.Add(1, labelValues...)
+}
+
+// -------------------------
+// Observe 記錄一筆觀測值
+func (_this *histogramVec) Observe(value float64, labelValues ...string) {
+	_key := strings.Join(labelValues, "\xff")
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	_v, ok := _this.values[_key]
+	if !ok {
+		_v = &histogramValue{counts: make([]uint64, len(_this.buckets))}
+		_this.values[_key] = _v
+	}
+	for i, _bound := range _this.buckets {
+		if value <= _bound {
+			_v.counts[i]++
+		}
+	}
+	_v.sum += value
+	_v.count++
+}
+
+// -------------------------
+// formatLabels 將標籤名稱與數值組成 {a="1",b="2"}
+func formatLabels(names []string, key string, extra ...string) string {
+	var _pairs []string
+	if len(names) > 0 {
+		_values := strings.Split(key, "\xff")
+		for i, _name := range names {
+			_value := ""
+			if i < len(_values) {
+				_value = _values[i]
+			}
+			_pairs = append(_pairs, fmt.Sprintf("%s=%q", _name, _value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		_pairs = append(_pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(_pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(_pairs, ",") + "}"
+}
+
+// -------------------------
+func sortedKeys[T any](values map[string]T) []string {
+	_keys := make([]string, 0, len(values))
+	for k := range values {
+		_keys = append(_keys, k)
+	}
+	sort.Strings(_keys)
+	return _keys
+}
+
+// -------------------------
+func (_this *metricVec) write(w io.Writer) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", _this.name, _this.help, _this.name, _this.kind)
+	if len(_this.labels) == 0 && len(_this.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", _this.name)
+		return
+	}
+	for _, _key := range sortedKeys(_this.values) {
+		fmt.Fprintf(w, "%s%s %g\n", _this.name, formatLabels(_this.labels, _key), _this.values[_key])
+	}
+}
+
+// -------------------------
+func (_this *histogramVec) write(w io.Writer) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", _this.name, _this.help, _this.name)
+	for _, _key := range sortedKeys(_this.values) {
+		_v := _this.values[_key]
+		for i, _bound := range _this.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", _this.name, formatLabels(_this.labels, _key, "le", strconv.FormatFloat(_bound, 'g', -1, 64)), _v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", _this.name, formatLabels(_this.labels, _key, "le", "+Inf"), _v.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", _this.name, formatLabels(_this.labels, _key), _v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", _this.name, formatLabels(_this.labels, _key), _v.count)
+	}
+}
+
+// -------------------------
+// writeGauge 輸出單一 Gauge
+func writeGauge(w io.Writer, name string, help string, value float64, labels ...string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(nil, "", labels...), value)
+}
+
+// -------------------------
+// metricsHandler 以 Prometheus 文字格式輸出所有指標
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// 每個 profile 各自輸出分配的 ID 與連線狀態
+	fmt.Fprintf(w, "# HELP netpass_info Client version and assigned ID per profile.\n# TYPE netpass_info gauge\n")
+	for _, _p := range runningProfiles() {
+		fmt.Fprintf(w, "netpass_info%s 1\n", formatLabels(nil, "", "version", defaultVersion, "profile", _p.settings().ID, "hw_id", _p.assignedID()))
+	}
+	fmt.Fprintf(w, "# HELP netpass_mqtt_connected Whether the MQTT connection of each profile is currently open.\n# TYPE netpass_mqtt_connected gauge\n")
+	for _, _p := range runningProfiles() {
+		_connected := 0
+		if _p.connected() {
+			_connected = 1
+		}
+		fmt.Fprintf(w, "netpass_mqtt_connected{profile=%q} %d\n", _p.settings().ID, _connected)
+	}
+	writeGauge(w, "netpass_uptime_seconds", "Seconds since the client started.", time.Since(startedAt).Seconds())
+
+	// 依類型統計進行中的連線
+	_active := map[string]int{kindHTTP: 0, kindWebSocket: 0, kindTCP: 0}
+	sessionLock.Lock()
+	for _, _s := range activeSessions {
+		_active[_s.Kind]++
+	}
+	sessionLock.Unlock()
+
+	fmt.Fprintf(w, "# HELP netpass_active_sessions Active HTTP proxies and tunnels by kind.\n# TYPE netpass_active_sessions gauge\n")
+	for _, _kind := range sortedKeys(_active) {
+		fmt.Fprintf(w, "netpass_active_sessions{kind=%q} %d\n", _kind, _active[_kind])
+	}
+
+	metricHTTPRequests.write(w)
+	metricHTTPDuration.write(w)
+	metricTunnelBytes.write(w)
+	metricTunnelsOpened.write(w)
+	metricMQTTReconnects.write(w)
+	metricHTTPSFallbacks.write(w)
+	metricRejected.write(w)
+	metricConfigReloads.write(w)
+	metricMuxConnects.write(w)
+	writePoolMetrics(w)
+}
+
+// -------------------------
+// startMetricsServer 在 metrics.listen 另外提供 /metrics，未設定時不啟動
+func startMetricsServer() {
+	_address := strings.TrimSpace(currentConfig().Metrics.Listen)
+	if _address == "" {
+		return
+	}
+
+	_mux := http.NewServeMux()
+	_mux.HandleFunc("GET /metrics", metricsHandler)
+
+	logInfof("[Metrics] Listening on %s", _address)
+	go func() {
+		if err := http.ListenAndServe(_address, _mux); err != nil {
+			logErrorf("[Metrics] Server stopped: %v", err)
+		}
+	}()
+}
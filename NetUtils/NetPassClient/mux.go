@@ -0,0 +1,480 @@
+package main
+
+// -------------------------
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// 多工隧道：每個 profile 只與伺服器維持一條 WSS 連線 (wss://host:18884/mux)，
+// 每個 WebSocket / TCP 連線是其中的一條 stream，省去每次連線的 TLS 交握
+//
+// Frame 格式 (以位元組流傳送，可跨越或合併 WebSocket 訊息)：
+//
+//	type (1) | stream id (4, big endian) | length (4, big endian) | payload (length)
+const (
+	muxFrameOpen   = 1 // Client 開啟 stream，payload 為 MQTT 請求中的 Token
+	muxFrameData   = 2 // payload 為 flags (1) + 資料；flags 低 7 位元為 WebSocket 訊息類型，最高位元表示後面還有同一訊息的片段
+	muxFrameClose  = 3 // 關閉 stream，payload 可帶 close code (2) + 原因
+	muxFrameWindow = 4 // 流量控制，payload 為增加的可傳送量 (4)
+)
+
+// -------------------------
+const muxHeaderSize = 9
+const muxMaxPayload = 32 * 1024  // 每個 DATA frame 最多攜帶的資料量
+const muxWindowSize = 256 * 1024 // 每條 stream 每個方向未確認的資料上限
+const muxMoreFragments = 0x80    // DATA flags：訊息尚未結束
+const muxPingInterval = 30 * time.Second
+const muxReadTimeout = 90 * time.Second
+const muxWriteTimeout = 10 * time.Second
+
+// -------------------------
+var errMuxClosed = errors.New("mux session closed")
+
+// -------------------------
+// tunnelConn 是 WebSocket / TCP 隧道使用的連線，可以是獨立的 WSS 連線或多工連線中的一條 stream
+type tunnelConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// -------------------------
+// muxSession 是與伺服器之間的一條多工連線
+type muxSession struct {
+	profile   *Profile
+	ws        *websocket.Conn
+	conn      net.Conn // 以 wsNetConn 將 WebSocket 視為位元組流
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	streams   map[uint32]*muxStream
+	nextID    uint32
+	done      chan struct{}
+	err       error // 非 nil 表示連線已中斷
+}
+
+// -------------------------
+// muxStream 是多工連線中的一條 stream，實作 tunnelConn
+type muxStream struct {
+	session  *muxSession
+	id       uint32
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    [][]byte // 已收到但尚未讀取的 DATA payload
+	buffered int      // queue 中的資料量
+	unacked  int      // 已讀取但尚未以 WINDOW 回報的資料量
+	window   int      // 還能送出的資料量
+	err      error    // 非 nil 表示 stream 已關閉
+}
+
+// -------------------------
+// openTunnel 為一個隧道請求開啟連線，啟用 mux 時使用多工連線，多工連線無法建立時改用獨立的 WSS 連線
+func (_this *Profile) openTunnel(token string) (tunnelConn, error) {
+	if currentConfig().Mux {
+		_session, err := _this.muxConn()
+		if err == nil {
+			_stream, err := _session.open(token)
+			if err != nil {
+				return nil, err
+			}
+			return _stream, nil
+		}
+		_this.tunnelLog(token).Warnf("[Mux] Connection failed: %v. Using a dedicated tunnel.", err)
+	}
+
+	_wsTunnel, err := _this.dialTunnel(token)
+	if err != nil {
+		return nil, err
+	}
+	return _wsTunnel, nil
+}
+
+// -------------------------
+// muxConn 回傳目前的多工連線，尚未建立或已中斷時重新連線
+func (_this *Profile) muxConn() (*muxSession, error) {
+	_this.muxLock.Lock()
+	defer _this.muxLock.Unlock()
+
+	if _this.mux != nil && !_this.mux.closed() {
+		return _this.mux, nil
+	}
+
+	_session, err := _this.dialMux()
+	if err != nil {
+		metricMuxConnects.Inc(_this.settings().ID, "error")
+		return nil, err
+	}
+	metricMuxConnects.Inc(_this.settings().ID, "ok")
+	_this.log().Infof("[Mux] Connected to %s", _this.getTunnelHost())
+	_this.mux = _session
+	return _session, nil
+}
+
+// -------------------------
+// closeMux 關閉多工連線與其中所有的 stream
+func (_this *Profile) closeMux() {
+	_this.muxLock.Lock()
+	_session := _this.mux
+	_this.mux = nil
+	_this.muxLock.Unlock()
+
+	if _session != nil {
+		_session.fail(errMuxClosed)
+	}
+}
+
+// -------------------------
+// dialMux 連線到伺服器的多工隧道端點
+func (_this *Profile) dialMux() (*muxSession, error) {
+	_muxURL := fmt.Sprintf("wss://%s:18884/mux?hwid=%s", _this.getTunnelHost(), url.QueryEscape(_this.assignedID()))
+	_dialer := websocket.Dialer{
+		TLSClientConfig: _this.serverTLSConfig(),
+	}
+	_ws, _, err := _dialer.Dial(_muxURL, _this.tunnelHeader())
+	if err != nil {
+		return nil, err
+	}
+	return newMuxSession(_this, _ws), nil
+}
+
+// -------------------------
+// newMuxSession 在已建立的 WebSocket 上開始多工連線
+func newMuxSession(profile *Profile, ws *websocket.Conn) *muxSession {
+	_conn := &wsNetConn{Conn: ws}
+	_session := &muxSession{
+		profile: profile,
+		ws:      ws,
+		conn:    _conn,
+		reader:  bufio.NewReaderSize(_conn, muxHeaderSize+muxMaxPayload+1),
+		streams: map[uint32]*muxStream{},
+		done:    make(chan struct{}),
+	}
+
+	// 伺服器回應 Ping 或送來任何資料都延長讀取期限，超過期限視為連線中斷
+	ws.SetReadDeadline(time.Now().Add(muxReadTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(muxReadTimeout))
+	})
+
+	go _session.readLoop()
+	go _session.keepAlive()
+	return _session
+}
+
+// -------------------------
+// open 開啟新的 stream 並送出 OPEN，伺服器依 Token 對應到等待中的連線
+func (_this *muxSession) open(token string) (*muxStream, error) {
+	_this.lock.Lock()
+	if err := _this.err; err != nil {
+		_this.lock.Unlock()
+		return nil, err
+	}
+	_this.nextID++
+	_stream := &muxStream{session: _this, id: _this.nextID, window: muxWindowSize}
+	_stream.cond = sync.NewCond(&_stream.lock)
+	_this.streams[_stream.id] = _stream
+	_this.lock.Unlock()
+
+	if err := _this.writeFrame(muxFrameOpen, _stream.id, []byte(token)); err != nil {
+		_this.remove(_stream.id)
+		return nil, err
+	}
+	return _stream, nil
+}
+
+// -------------------------
+// closed 回傳多工連線是否已中斷
+func (_this *muxSession) closed() bool {
+	select {
+	case <-_this.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// -------------------------
+// fail 中斷多工連線，所有 stream 以同樣的錯誤結束
+func (_this *muxSession) fail(err error) {
+	_this.lock.Lock()
+	if _this.err != nil {
+		_this.lock.Unlock()
+		return
+	}
+	_this.err = err
+	_streams := _this.streams
+	_this.streams = map[uint32]*muxStream{}
+	close(_this.done)
+	_this.lock.Unlock()
+
+	_this.ws.Close()
+	for _, _stream := range _streams {
+		_stream.abort(err)
+	}
+	if err != errMuxClosed {
+		_this.profile.log().Warnf("[Mux] Disconnected: %v (%d stream(s) closed)", err, len(_streams))
+	}
+}
+
+// -------------------------
+// writeFrame 送出一個 frame，header 與 payload 以同一則 WebSocket 訊息送出
+func (_this *muxSession) writeFrame(frameType byte, id uint32, parts ...[]byte) error {
+	_size := 0
+	for _, _part := range parts {
+		_size += len(_part)
+	}
+	_frame := make([]byte, muxHeaderSize, muxHeaderSize+_size)
+	_frame[0] = frameType
+	binary.BigEndian.PutUint32(_frame[1:5], id)
+	binary.BigEndian.PutUint32(_frame[5:9], uint32(_size))
+	for _, _part := range parts {
+		_frame = append(_frame, _part...)
+	}
+
+	_this.writeLock.Lock()
+	defer _this.writeLock.Unlock()
+	_this.lock.Lock()
+	err := _this.err
+	_this.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	_this.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if _, err := _this.conn.Write(_frame); err != nil {
+		_this.fail(err)
+		return err
+	}
+	return nil
+}
+
+// -------------------------
+// readLoop 讀取伺服器送來的 frame 並分派給對應的 stream
+func (_this *muxSession) readLoop() {
+	_header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(_this.reader, _header); err != nil {
+			_this.fail(err)
+			return
+		}
+		_type := _header[0]
+		_id := binary.BigEndian.Uint32(_header[1:5])
+		_length := binary.BigEndian.Uint32(_header[5:9])
+		if _length > muxMaxPayload+1 {
+			_this.fail(fmt.Errorf("frame of %d bytes exceeds the limit", _length))
+			return
+		}
+		_payload := make([]byte, _length)
+		if _, err := io.ReadFull(_this.reader, _payload); err != nil {
+			_this.fail(err)
+			return
+		}
+		_this.ws.SetReadDeadline(time.Now().Add(muxReadTimeout))
+
+		_this.lock.Lock()
+		_stream := _this.streams[_id]
+		_this.lock.Unlock()
+
+		switch _type {
+		case muxFrameData:
+			if _stream != nil && len(_payload) > 0 {
+				_stream.push(_payload)
+			}
+		case muxFrameWindow:
+			if _stream != nil && len(_payload) == 4 {
+				_stream.grant(int(binary.BigEndian.Uint32(_payload)))
+			}
+		case muxFrameClose:
+			if _stream != nil {
+				_stream.remoteClose(_payload)
+			}
+		case muxFrameOpen:
+			// 只有 Client 能開啟 stream
+			_this.writeFrame(muxFrameClose, _id, closePayload(websocket.CloseProtocolError, "streams are opened by the client"))
+		}
+	}
+}
+
+// -------------------------
+// keepAlive 定時送出 Ping，讓中間的 Proxy 不會因閒置而中斷，也用來偵測失效的連線
+func (_this *muxSession) keepAlive() {
+	_ticker := time.NewTicker(muxPingInterval)
+	defer _ticker.Stop()
+	for {
+		select {
+		case <-_this.done:
+			return
+		case <-_ticker.C:
+			if err := _this.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(muxWriteTimeout)); err != nil {
+				_this.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// -------------------------
+// remove 將 stream 從多工連線中移除
+func (_this *muxSession) remove(id uint32) {
+	_this.lock.Lock()
+	delete(_this.streams, id)
+	_this.lock.Unlock()
+}
+
+// -------------------------
+func closePayload(code int, reason string) []byte {
+	_payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(_payload, uint16(code))
+	return append(_payload, reason...)
+}
+
+// -------------------------
+// push 收到 DATA，超過流量控制的上限時視為協定錯誤並關閉 stream
+func (_this *muxStream) push(payload []byte) {
+	_this.lock.Lock()
+	if _this.err != nil {
+		_this.lock.Unlock()
+		return
+	}
+	if _this.buffered+len(payload)-1 > muxWindowSize {
+		_this.lock.Unlock()
+		_this.closeWith(websocket.CloseProtocolError, "flow control window exceeded")
+		return
+	}
+	_this.queue = append(_this.queue, payload)
+	_this.buffered += len(payload) - 1
+	_this.cond.Broadcast()
+	_this.lock.Unlock()
+}
+
+// -------------------------
+// grant 伺服器已讀取資料，增加可傳送量
+func (_this *muxStream) grant(n int) {
+	_this.lock.Lock()
+	_this.window += n
+	_this.cond.Broadcast()
+	_this.lock.Unlock()
+}
+
+// -------------------------
+// remoteClose 伺服器關閉 stream，尚未讀取的資料仍可讀完
+func (_this *muxStream) remoteClose(payload []byte) {
+	_err := error(io.EOF)
+	if len(payload) >= 2 {
+		_err = &websocket.CloseError{Code: int(binary.BigEndian.Uint16(payload)), Text: string(payload[2:])}
+	}
+	_this.abort(_err)
+	_this.session.remove(_this.id)
+}
+
+// -------------------------
+// abort 以指定的錯誤結束 stream，不通知伺服器
+func (_this *muxStream) abort(err error) {
+	_this.lock.Lock()
+	if _this.err == nil {
+		_this.err = err
+	}
+	_this.cond.Broadcast()
+	_this.lock.Unlock()
+}
+
+// -------------------------
+// ReadMessage 讀取一則完整的訊息，讀取後回報 WINDOW 讓伺服器繼續傳送
+func (_this *muxStream) ReadMessage() (int, []byte, error) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	var _message []byte
+	for {
+		for len(_this.queue) == 0 && _this.err == nil {
+			_this.cond.Wait()
+		}
+		if len(_this.queue) == 0 {
+			return 0, nil, _this.err
+		}
+
+		_payload := _this.queue[0]
+		_this.queue = _this.queue[1:]
+		_this.buffered -= len(_payload) - 1
+		_this.unacked += len(_payload) - 1
+		_message = append(_message, _payload[1:]...)
+
+		// 每讀取半個 Window 回報一次；訊息大於 Window 時也要在讀完前回報，否則伺服器無法送出剩下的片段
+		if _this.unacked >= muxWindowSize/2 {
+			_increment := make([]byte, 4)
+			binary.BigEndian.PutUint32(_increment, uint32(_this.unacked))
+			_this.unacked = 0
+			_this.lock.Unlock()
+			_this.session.writeFrame(muxFrameWindow, _this.id, _increment)
+			_this.lock.Lock()
+		}
+
+		if _payload[0]&muxMoreFragments == 0 {
+			return int(_payload[0] &^ muxMoreFragments), _message, nil
+		}
+	}
+}
+
+// -------------------------
+// WriteMessage 送出一則訊息，超過 frame 上限時分段送出，Window 用盡時等待伺服器回報
+func (_this *muxStream) WriteMessage(messageType int, data []byte) error {
+	for {
+		_this.lock.Lock()
+		for _this.window <= 0 && _this.err == nil {
+			_this.cond.Wait()
+		}
+		if _this.err != nil {
+			_err := _this.err
+			_this.lock.Unlock()
+			return _err
+		}
+		_n := min(len(data), _this.window, muxMaxPayload)
+		_this.window -= _n
+		_this.lock.Unlock()
+
+		_flags := byte(messageType)
+		if _n < len(data) {
+			_flags |= muxMoreFragments
+		}
+		if err := _this.session.writeFrame(muxFrameData, _this.id, []byte{_flags}, data[:_n]); err != nil {
+			return err
+		}
+		data = data[_n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// -------------------------
+// Close 關閉 stream 並通知伺服器
+func (_this *muxStream) Close() error {
+	return _this.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// -------------------------
+// closeWith 以指定的 close code 關閉 stream，伺服器已關閉時不再通知
+func (_this *muxStream) closeWith(code int, reason string) error {
+	_this.lock.Lock()
+	if _this.err != nil {
+		_this.lock.Unlock()
+		return nil
+	}
+	_this.err = net.ErrClosed
+	_this.queue = nil
+	_this.cond.Broadcast()
+	_this.lock.Unlock()
+
+	_this.session.remove(_this.id)
+	return _this.session.writeFrame(muxFrameClose, _this.id, closePayload(code, reason))
+}
@@ -0,0 +1,344 @@
+package main
+
+// -------------------------
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// muxPeer 扮演伺服器端，直接讀寫 frame 的位元組
+type muxPeer struct {
+	t      *testing.T
+	ws     *websocket.Conn
+	reader *bufio.Reader
+}
+
+// -------------------------
+// muxFrame 是 muxPeer 讀到的一個 frame
+type muxFrame struct {
+	frameType byte
+	id        uint32
+	payload   []byte
+}
+
+// -------------------------
+// newTestMux 透過本機 WebSocket 建立多工連線，回傳 Client 端的 session 與伺服器端的 peer
+func newTestMux(t *testing.T) (*muxSession, *muxPeer) {
+	t.Helper()
+
+	_accepted := make(chan *websocket.Conn, 1)
+	_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_accepted <- _ws
+	}))
+	t.Cleanup(_server.Close)
+
+	_client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(_server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ws := <-_accepted
+	t.Cleanup(func() { _ws.Close() })
+
+	_profile := &Profile{}
+	_profile.config.Store(&ProfileConfig{ID: "test"})
+	_session := newMuxSession(_profile, _client)
+	t.Cleanup(func() { _session.fail(errMuxClosed) })
+
+	return _session, &muxPeer{t: t, ws: _ws, reader: bufio.NewReader(&wsNetConn{Conn: _ws})}
+}
+
+// -------------------------
+// encodeFrame 依 frame 格式組出位元組
+func encodeFrame(frameType byte, id uint32, payload []byte) []byte {
+	_frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	_frame[0] = frameType
+	binary.BigEndian.PutUint32(_frame[1:5], id)
+	binary.BigEndian.PutUint32(_frame[5:9], uint32(len(payload)))
+	return append(_frame, payload...)
+}
+
+// -------------------------
+// testData 產生指定長度、內容可辨識的資料
+func testData(n int) []byte {
+	_data := make([]byte, n)
+	for i := 0; i < n; i++ {
+		_data[i] = byte(i % 251)
+	}
+	return _data
+}
+
+// -------------------------
+// read 讀取下一個 frame，逾時視為測試失敗
+func (_this *muxPeer) read() muxFrame {
+	_this.t.Helper()
+	_this.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(_this.reader, _header); err != nil {
+		_this.t.Fatalf("read frame header: %v", err)
+	}
+	_payload := make([]byte, binary.BigEndian.Uint32(_header[5:9]))
+	if _, err := io.ReadFull(_this.reader, _payload); err != nil {
+		_this.t.Fatalf("read frame payload: %v", err)
+	}
+	return muxFrame{frameType: _header[0], id: binary.BigEndian.Uint32(_header[1:5]), payload: _payload}
+}
+
+// -------------------------
+// send 將位元組以每則最多 size 的 WebSocket 訊息送出，size 為 0 時整批送出
+func (_this *muxPeer) send(data []byte, size int) {
+	_this.t.Helper()
+	if size <= 0 {
+		size = len(data)
+	}
+	for len(data) > 0 {
+		_n := min(size, len(data))
+		if err := _this.ws.WriteMessage(websocket.BinaryMessage, data[:_n]); err != nil {
+			_this.t.Fatalf("write: %v", err)
+		}
+		data = data[_n:]
+	}
+}
+
+// -------------------------
+// openStream 開啟 stream 並確認伺服器收到 OPEN
+func openStream(t *testing.T, session *muxSession, peer *muxPeer, token string) *muxStream {
+	t.Helper()
+	_stream, err := session.open(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_frame := peer.read()
+	if _frame.frameType != muxFrameOpen || _frame.id != _stream.id || string(_frame.payload) != token {
+		t.Fatalf("got frame %d/%d %q, want OPEN/%d %q", _frame.frameType, _frame.id, _frame.payload, _stream.id, token)
+	}
+	return _stream
+}
+
+// -------------------------
+// writeAsync 在背景送出訊息，WriteMessage 可能因 Window 用盡而等待
+func writeAsync(stream *muxStream, messageType int, data []byte) <-chan error {
+	_done := make(chan error, 1)
+	go func() { _done <- stream.WriteMessage(messageType, data) }()
+	return _done
+}
+
+// -------------------------
+func TestMuxFraming(t *testing.T) {
+	type _fragment struct {
+		flags byte
+		size  int
+	}
+	_tests := []struct {
+		name        string
+		messageType int
+		size        int
+		want        []_fragment
+		split       int // 伺服器回傳時每則 WebSocket 訊息的大小，0 代表整批送出
+	}{
+		{"text", websocket.TextMessage, 5, []_fragment{{websocket.TextMessage, 5}}, 0},
+		{"empty", websocket.BinaryMessage, 0, []_fragment{{websocket.BinaryMessage, 0}}, 0},
+		{"header split across messages", websocket.TextMessage, 20, []_fragment{{websocket.TextMessage, 20}}, 4},
+		{"one full frame", websocket.BinaryMessage, muxMaxPayload, []_fragment{{websocket.BinaryMessage, muxMaxPayload}}, 1000},
+		{"fragmented", websocket.BinaryMessage, 2*muxMaxPayload + 100, []_fragment{
+			{websocket.BinaryMessage | muxMoreFragments, muxMaxPayload},
+			{websocket.BinaryMessage | muxMoreFragments, muxMaxPayload},
+			{websocket.BinaryMessage, 100},
+		}, 7000},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_session, _peer := newTestMux(t)
+			_stream := openStream(t, _session, _peer, "token-"+_tt.name)
+			_data := testData(_tt.size)
+
+			// Client → 伺服器：依上限切成 DATA frame，最後一段清除 more 旗標
+			_done := writeAsync(_stream, _tt.messageType, _data)
+			var _received []byte
+			var _raw []byte
+			for i, _want := range _tt.want {
+				_frame := _peer.read()
+				if _frame.frameType != muxFrameData || _frame.id != _stream.id {
+					t.Fatalf("fragment %d: got frame %d/%d, want DATA/%d", i, _frame.frameType, _frame.id, _stream.id)
+				}
+				if _frame.payload[0] != _want.flags || len(_frame.payload)-1 != _want.size {
+					t.Fatalf("fragment %d: got flags %#x with %d bytes, want %#x with %d bytes", i, _frame.payload[0], len(_frame.payload)-1, _want.flags, _want.size)
+				}
+				_received = append(_received, _frame.payload[1:]...)
+				_raw = append(_raw, encodeFrame(muxFrameData, _stream.id, _frame.payload)...)
+			}
+			if err := <-_done; err != nil {
+				t.Fatalf("WriteMessage: %v", err)
+			}
+			if !bytes.Equal(_received, _data) {
+				t.Fatal("fragments do not add up to the message")
+			}
+
+			// 伺服器 → Client：相同的 frame 任意切割成 WebSocket 訊息，ReadMessage 仍要組回完整訊息
+			_peer.send(_raw, _tt.split)
+			_type, _message, err := _stream.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if _type != _tt.messageType || !bytes.Equal(_message, _data) {
+				t.Fatalf("got type %d with %d bytes, want type %d with %d bytes", _type, len(_message), _tt.messageType, len(_data))
+			}
+		})
+	}
+}
+
+// -------------------------
+func TestMuxRejectsOversizedFrame(t *testing.T) {
+	_session, _peer := newTestMux(t)
+	_stream := openStream(t, _session, _peer, "token")
+
+	_header := encodeFrame(muxFrameData, _stream.id, nil)
+	binary.BigEndian.PutUint32(_header[5:9], muxMaxPayload+2)
+	_peer.send(_header, 0)
+
+	select {
+	case <-_session.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open after an oversized frame")
+	}
+	if _, _, err := _stream.ReadMessage(); err == nil {
+		t.Fatal("stream still readable after the session failed")
+	}
+}
+
+// -------------------------
+func TestMuxReceiveWindow(t *testing.T) {
+	_tests := []struct {
+		name  string
+		extra int // 超出 Window 的資料量
+	}{
+		{"exactly the window", 0},
+		{"one byte over the window", 1},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_session, _peer := newTestMux(t)
+			_stream := openStream(t, _session, _peer, "token")
+
+			// 伺服器在 Client 未讀取的情況下送滿整個 Window
+			_frames := muxWindowSize / muxMaxPayload
+			var _raw []byte
+			for i := 0; i < _frames; i++ {
+				_payload := append([]byte{websocket.BinaryMessage}, testData(muxMaxPayload)...)
+				_raw = append(_raw, encodeFrame(muxFrameData, _stream.id, _payload)...)
+			}
+			if _tt.extra > 0 {
+				_payload := append([]byte{websocket.BinaryMessage}, testData(_tt.extra)...)
+				_raw = append(_raw, encodeFrame(muxFrameData, _stream.id, _payload)...)
+			}
+			_peer.send(_raw, 0)
+
+			if _tt.extra > 0 {
+				// 超出 Window 是協定錯誤：stream 以 1002 關閉，已收到的資料一併丟棄
+				_frame := _peer.read()
+				if _frame.frameType != muxFrameClose || _frame.id != _stream.id || len(_frame.payload) < 2 {
+					t.Fatalf("got frame %d/%d %q, want CLOSE/%d", _frame.frameType, _frame.id, _frame.payload, _stream.id)
+				}
+				if _code := binary.BigEndian.Uint16(_frame.payload); _code != websocket.CloseProtocolError {
+					t.Fatalf("got close code %d, want %d", _code, websocket.CloseProtocolError)
+				}
+				if _, _, err := _stream.ReadMessage(); !errors.Is(err, net.ErrClosed) {
+					t.Fatalf("ReadMessage after protocol error: got %v, want %v", err, net.ErrClosed)
+				}
+				return
+			}
+
+			// 每讀取半個 Window 回報一次 WINDOW
+			for i := 0; i < _frames; i++ {
+				if _, _message, err := _stream.ReadMessage(); err != nil || len(_message) != muxMaxPayload {
+					t.Fatalf("message %d: got %d bytes, %v", i, len(_message), err)
+				}
+				if (i+1)%(_frames/2) != 0 {
+					continue
+				}
+				_frame := _peer.read()
+				if _frame.frameType != muxFrameWindow || _frame.id != _stream.id || len(_frame.payload) != 4 {
+					t.Fatalf("got frame %d/%d %q, want WINDOW/%d", _frame.frameType, _frame.id, _frame.payload, _stream.id)
+				}
+				if _increment := binary.BigEndian.Uint32(_frame.payload); _increment != muxWindowSize/2 {
+					t.Fatalf("got window increment %d, want %d", _increment, muxWindowSize/2)
+				}
+			}
+		})
+	}
+}
+
+// -------------------------
+func TestMuxSendWindow(t *testing.T) {
+	_tests := []struct {
+		name  string
+		size  int
+		grant int // 送完 Window 後伺服器回報的可傳送量
+	}{
+		{"fits the window", muxWindowSize, 0},
+		{"waits for a grant", muxWindowSize + 10, 10},
+		{"partial grants", muxWindowSize + 100, 40},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_session, _peer := newTestMux(t)
+			_stream := openStream(t, _session, _peer, "token")
+
+			_done := writeAsync(_stream, websocket.BinaryMessage, testData(_tt.size))
+			_sent := 0
+			for _sent < muxWindowSize {
+				_sent += len(_peer.read().payload) - 1
+			}
+			if _sent != muxWindowSize {
+				t.Fatalf("sent %d bytes before waiting, want %d", _sent, muxWindowSize)
+			}
+
+			for _sent < _tt.size {
+				// Window 用盡時必須等待伺服器回報
+				select {
+				case err := <-_done:
+					t.Fatalf("WriteMessage returned %v with %d of %d bytes sent and no window left", err, _sent, _tt.size)
+				case <-time.After(100 * time.Millisecond):
+				}
+
+				_increment := make([]byte, 4)
+				binary.BigEndian.PutUint32(_increment, uint32(_tt.grant))
+				_peer.send(encodeFrame(muxFrameWindow, _stream.id, _increment), 0)
+
+				_frame := _peer.read()
+				_n := len(_frame.payload) - 1
+				if _want := min(_tt.grant, _tt.size-_sent); _n != _want {
+					t.Fatalf("sent %d bytes after a grant of %d, want %d", _n, _tt.grant, _want)
+				}
+				_sent += _n
+				if _last := _sent == _tt.size; (_frame.payload[0]&muxMoreFragments == 0) != _last {
+					t.Fatalf("fragment ending at %d has flags %#x", _sent, _frame.payload[0])
+				}
+			}
+
+			select {
+			case err := <-_done:
+				if err != nil {
+					t.Fatalf("WriteMessage: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("WriteMessage did not return after the whole message was sent")
+			}
+		})
+	}
+}
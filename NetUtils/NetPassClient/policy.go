@@ -0,0 +1,251 @@
+package main
+
+// -------------------------
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// -------------------------
+// 請求類型，對應 PortRule.Types 內可設定的值
+const (
+	kindHTTP      = "http"
+	kindWebSocket = "websocket"
+	kindTCP       = "tcp"
+)
+
+// -------------------------
+// PortRule 定義單一對外開放的本地 Port 以及允許的流量類型
+type PortRule struct {
+	Port  int      `json:"port"`  // 本地 Port
+	Types []string `json:"types"` // 允許的類型 (http / websocket / tcp)，空值代表全部允許
+}
+
+// -------------------------
+// PortPolicy 定義本地 Port 的開放清單與拒絕清單
+type PortPolicy struct {
+	Allow []PortRule `json:"allow"` // 開放的 Port 與類型
+	Deny  []int      `json:"deny"`  // 一律拒絕的 Port (優先於 Allow)
+}
+
+// -------------------------
+// allowsType 判斷類型清單是否包含指定類型，空清單代表全部允許
+func allowsType(types []string, kind string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, _t := range types {
+		if strings.EqualFold(strings.TrimSpace(_t), kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------------
+// validateTypes 檢查類型清單是否只包含已知的類型
+func validateTypes(types []string) error {
+	for _, _t := range types {
+		switch strings.ToLower(strings.TrimSpace(_t)) {
+		case kindHTTP, kindWebSocket, kindTCP:
+		default:
+			return fmt.Errorf("unknown type %q", _t)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// parsePort 將 Broker 傳來的 Port 字串轉為數字並檢查範圍
+func parsePort(port string) (int, error) {
+	_port, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || _port <= 0 || _port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return _port, nil
+}
+
+// -------------------------
+// Check 檢查指定 Port 與請求類型是否被允許，未設定 Policy 時維持舊版全開行為
+func (_this *PortPolicy) Check(port string, kind string) error {
+	_port, err := parsePort(port)
+	if err != nil {
+		return err
+	}
+
+	if _service := reservedPort(_port); _service != "" {
+		return fmt.Errorf("port %d is reserved for the %s", _port, _service)
+	}
+
+	if _this == nil {
+		return nil
+	}
+
+	for _, _deny := range _this.Deny {
+		if _deny == _port {
+			return fmt.Errorf("port %d is denied", _port)
+		}
+	}
+
+	for _, _rule := range _this.Allow {
+		if _rule.Port != _port {
+			continue
+		}
+		if !allowsType(_rule.Types, kind) {
+			return fmt.Errorf("%s traffic is not allowed on port %d", kind, _port)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("port %d is not exposed", _port)
+}
+
+// -------------------------
+// reservedPort 回傳本機管理 API 或指標服務使用該 Port 時的名稱，這些 Port 不論 Policy 為何一律不對外開放
+func reservedPort(port int) string {
+	_config := currentConfig()
+	_services := []struct {
+		name    string
+		address string
+	}{
+		{"admin API", _config.Admin.Listen},
+		{"metrics endpoint", _config.Metrics.Listen},
+	}
+	for _, _s := range _services {
+		_address := strings.TrimSpace(_s.address)
+		if _address == "" || strings.HasPrefix(_address, "unix:") {
+			continue
+		}
+		if _, _p, err := net.SplitHostPort(_address); err == nil && _p == strconv.Itoa(port) {
+			return _s.name
+		}
+	}
+	return ""
+}
+
+// -------------------------
+// isLoopbackHost 判斷主機名稱是否指向本機
+func isLoopbackHost(host string) bool {
+	host = strings.Trim(strings.TrimSpace(host), "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	_ip := net.ParseIP(host)
+	return _ip != nil && _ip.IsLoopback()
+}
+
+// -------------------------
+// Validate 檢查設定內容是否合法
+func (_this *PortPolicy) Validate() error {
+	if _this == nil {
+		return nil
+	}
+	for _, _rule := range _this.Allow {
+		if _rule.Port <= 0 || _rule.Port > 65535 {
+			return fmt.Errorf("ports.allow: invalid port %d", _rule.Port)
+		}
+		if err := validateTypes(_rule.Types); err != nil {
+			return fmt.Errorf("ports.allow: port %d: %v", _rule.Port, err)
+		}
+	}
+	for _, _deny := range _this.Deny {
+		if _deny <= 0 || _deny > 65535 {
+			return fmt.Errorf("ports.deny: invalid port %d", _deny)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// Target 定義可被轉發的區網主機 (例如 PLC、攝影機、NAS)
+type Target struct {
+	Name  string   `json:"name"`  // Broker 用來指定目標的名稱
+	Host  string   `json:"host"`  // 區網主機位址 (IP 或主機名稱)
+	Port  int      `json:"port"`  // 目標 Port
+	Types []string `json:"types"` // 允許的類型 (http / websocket / tcp)，空值代表全部允許
+}
+
+// -------------------------
+// validateTargets 檢查區網目標設定是否合法
+func validateTargets(targets []Target) error {
+	_names := map[string]bool{}
+	for _, _t := range targets {
+		_name := strings.ToLower(strings.TrimSpace(_t.Name))
+		if _name == "" || _name == "localhost" {
+			return fmt.Errorf("targets: invalid name %q", _t.Name)
+		}
+		if _names[_name] {
+			return fmt.Errorf("targets: duplicate name %q", _t.Name)
+		}
+		_names[_name] = true
+
+		if strings.TrimSpace(_t.Host) == "" {
+			return fmt.Errorf("targets: %s: host is required", _t.Name)
+		}
+		if _t.Port <= 0 || _t.Port > 65535 {
+			return fmt.Errorf("targets: %s: invalid port %d", _t.Name, _t.Port)
+		}
+		if err := validateTypes(_t.Types); err != nil {
+			return fmt.Errorf("targets: %s: %v", _t.Name, err)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// resolveTarget 依據請求的 target_host 決定實際連線的主機與 Port
+// target_host 為空或 localhost 時沿用本機 Port Policy；否則必須是已設定的目標名稱，
+// 或是與某個目標 host 及 target_port 完全相符的位址
+func (_this *Profile) resolveTarget(payload HttpRequestPayload, kind string) (string, string, error) {
+	_config := _this.settings()
+	_ports, _targets := _config.Ports, _config.Targets
+
+	_name := strings.TrimSpace(payload.TargetHost)
+	if _name == "" || strings.EqualFold(_name, "localhost") {
+		if err := _ports.Check(payload.TargetPort, kind); err != nil {
+			return "", "", err
+		}
+		return "localhost", strings.TrimSpace(payload.TargetPort), nil
+	}
+
+	var _match *Target
+	for _i := range _targets {
+		_t := &_targets[_i]
+		if strings.EqualFold(_t.Name, _name) {
+			_match = _t
+			break
+		}
+	}
+
+	// 以 host 指定時，Port 也必須與設定相符
+	if _match == nil {
+		_port, err := parsePort(payload.TargetPort)
+		if err != nil {
+			return "", "", err
+		}
+		for _i := range _targets {
+			_t := &_targets[_i]
+			if strings.EqualFold(_t.Host, _name) && _t.Port == _port {
+				_match = _t
+				break
+			}
+		}
+	}
+
+	if _match == nil {
+		return "", "", fmt.Errorf("target %q is not configured", _name)
+	}
+	if !allowsType(_match.Types, kind) {
+		return "", "", fmt.Errorf("%s traffic is not allowed to target %q", kind, _match.Name)
+	}
+	// 指向本機的目標同樣不能繞過管理 API 與指標服務的保護
+	if isLoopbackHost(_match.Host) {
+		if _service := reservedPort(_match.Port); _service != "" {
+			return "", "", fmt.Errorf("port %d is reserved for the %s", _match.Port, _service)
+		}
+	}
+
+	return _match.Host, strconv.Itoa(_match.Port), nil
+}
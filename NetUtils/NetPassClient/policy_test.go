@@ -0,0 +1,134 @@
+package main
+
+// -------------------------
+import (
+	"strings"
+	"testing"
+)
+
+// -------------------------
+// useConfig 在測試期間套用全域設定，結束後還原
+func useConfig(t *testing.T, config Config) {
+	t.Helper()
+	_previous := Global.config.Load()
+	Global.config.Store(&config)
+	t.Cleanup(func() { Global.config.Store(_previous) })
+}
+
+// -------------------------
+// checkError 比對錯誤訊息，want 為空代表不應有錯誤
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("expected error containing %q, got nil", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("expected error containing %q, got %q", want, err.Error())
+	}
+}
+
+// -------------------------
+func TestPortPolicyCheck(t *testing.T) {
+	useConfig(t, Config{
+		Admin:   AdminConfig{Listen: "127.0.0.1:18900"},
+		Metrics: MetricsConfig{Listen: "0.0.0.0:9100"},
+	})
+
+	_policy := &PortPolicy{
+		Allow: []PortRule{
+			{Port: 80},
+			{Port: 22, Types: []string{"TCP"}},
+			{Port: 8080, Types: []string{kindHTTP, kindWebSocket}},
+			{Port: 3000},
+		},
+		Deny: []int{3000},
+	}
+
+	_tests := []struct {
+		name   string
+		policy *PortPolicy
+		port   string
+		kind   string
+		want   string
+	}{
+		{"nil policy allows any port", nil, "8443", kindTCP, ""},
+		{"nil policy still protects admin port", nil, "18900", kindHTTP, "reserved for the admin API"},
+		{"nil policy still protects metrics port", nil, "9100", kindHTTP, "reserved for the metrics endpoint"},
+		{"allowed without types", _policy, "80", kindTCP, ""},
+		{"allowed type is case insensitive", _policy, "22", kindTCP, ""},
+		{"type not allowed", _policy, "22", kindHTTP, "http traffic is not allowed on port 22"},
+		{"one of several types", _policy, "8080", kindWebSocket, ""},
+		{"deny wins over allow", _policy, "3000", kindHTTP, "port 3000 is denied"},
+		{"not exposed", _policy, "8081", kindHTTP, "port 8081 is not exposed"},
+		{"reserved even when allowed", &PortPolicy{Allow: []PortRule{{Port: 18900}}}, "18900", kindHTTP, "reserved for the admin API"},
+		{"surrounding spaces", _policy, " 80 ", kindHTTP, ""},
+		{"not a number", _policy, "http", kindHTTP, "invalid port"},
+		{"zero", nil, "0", kindHTTP, "invalid port"},
+		{"out of range", nil, "65536", kindHTTP, "invalid port"},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			checkError(t, _tt.policy.Check(_tt.port, _tt.kind), _tt.want)
+		})
+	}
+}
+
+// -------------------------
+func TestReservedPortIgnoresUnixSockets(t *testing.T) {
+	useConfig(t, Config{Admin: AdminConfig{Listen: "unix:/run/netpass.sock"}})
+
+	if _service := reservedPort(18900); _service != "" {
+		t.Fatalf("unix socket reserved port 18900 for the %s", _service)
+	}
+}
+
+// -------------------------
+func TestResolveTarget(t *testing.T) {
+	useConfig(t, Config{Admin: AdminConfig{Listen: "localhost:18900"}})
+
+	_profile := &Profile{}
+	_profile.config.Store(&ProfileConfig{
+		ID:    "test",
+		Ports: &PortPolicy{Allow: []PortRule{{Port: 8080}}},
+		Targets: []Target{
+			{Name: "nas", Host: "192.168.1.20", Port: 5000},
+			{Name: "camera", Host: "192.168.1.30", Port: 554, Types: []string{kindTCP}},
+			{Name: "loopback", Host: "127.0.0.1", Port: 18900},
+		},
+	})
+
+	_tests := []struct {
+		name     string
+		host     string
+		port     string
+		kind     string
+		wantHost string
+		wantPort string
+		want     string
+	}{
+		{"empty host uses local policy", "", "8080", kindHTTP, "localhost", "8080", ""},
+		{"localhost uses local policy", "LOCALHOST", " 8080 ", kindHTTP, "localhost", "8080", ""},
+		{"local port not exposed", "", "8081", kindHTTP, "", "", "port 8081 is not exposed"},
+		{"local admin port", "localhost", "18900", kindHTTP, "", "", "reserved for the admin API"},
+		{"by name ignores requested port", "NAS", "1", kindHTTP, "192.168.1.20", "5000", ""},
+		{"by host and port", "192.168.1.20", "5000", kindWebSocket, "192.168.1.20", "5000", ""},
+		{"by host with other port", "192.168.1.20", "5001", kindHTTP, "", "", `target "192.168.1.20" is not configured`},
+		{"by host with invalid port", "192.168.1.20", "x", kindHTTP, "", "", "invalid port"},
+		{"unknown target", "printer", "80", kindHTTP, "", "", `target "printer" is not configured`},
+		{"type allowed", "camera", "", kindTCP, "192.168.1.30", "554", ""},
+		{"type not allowed", "camera", "", kindHTTP, "", "", `http traffic is not allowed to target "camera"`},
+		{"loopback target on admin port", "loopback", "", kindHTTP, "", "", "reserved for the admin API"},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_payload := HttpRequestPayload{TargetHost: _tt.host, TargetPort: _tt.port}
+			_host, _port, err := _profile.resolveTarget(_payload, _tt.kind)
+			checkError(t, err, _tt.want)
+			if _host != _tt.wantHost || _port != _tt.wantPort {
+				t.Fatalf("resolved %q:%q, want %q:%q", _host, _port, _tt.wantHost, _tt.wantPort)
+			}
+		})
+	}
+}
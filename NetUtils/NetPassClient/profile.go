@@ -0,0 +1,397 @@
+package main
+
+// -------------------------
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// -------------------------
+const defaultProfileID = "default"
+
+// -------------------------
+// ProfileConfig 定義一組裝置身分，每個 profile 各自向伺服器註冊 ID 並建立獨立的 MQTT 連線
+// 未設定的欄位沿用 config.json 最外層的設定
+type ProfileConfig struct {
+	ID       string      `json:"id"` // profile 名稱，用於日誌、管理 API 與指標，預設 profile-<序號>
+	ApiKey   string      `json:"api_key"`
+	AuthMode string      `json:"auth_mode"`
+	Host     string      `json:"host"`
+	Name     string      `json:"name"`
+	TLS      *TLSConfig  `json:"tls"`
+	MQTT     *MQTTConfig `json:"mqtt"`
+	Ports    *PortPolicy `json:"ports"`
+	Targets  []Target    `json:"targets"`
+}
+
+// -------------------------
+// Profile 是執行中的 profile，持有分配的 ID 與自己的 MQTT 連線
+// config 與 hwID 可能在重新載入或重新註冊時被替換，讀取時使用 settings / assignedID
+type Profile struct {
+	config       atomic.Pointer[ProfileConfig]
+	index        int
+	hwID         atomic.Pointer[string]
+	serverTLS    *tls.Config // 連線伺服器用的 TLS 設定 (由 tls 建立)
+	lock         sync.RWMutex
+	client       mqtt.Client // 目前的 MQTT 連線
+	token        string      // 金鑰認證取得的短效 Token
+	tokenExpires time.Time
+	mux          *muxSession // 多工隧道連線 (mux 啟用時)
+	muxLock      sync.Mutex
+}
+
+// -------------------------
+// resolveProfiles 將 profiles 補上最外層的預設值 (設定已由 validate 檢查)
+// 未設定 profiles 時，以最外層的 api_key、host、name 等欄位組成單一的 default profile
+func resolveProfiles(config *Config) {
+	if len(config.Profiles) == 0 {
+		config.Profiles = []ProfileConfig{{ID: defaultProfileID}}
+	}
+
+	_seen := map[string]bool{}
+	_profiles := make([]ProfileConfig, 0, len(config.Profiles))
+	for i, _p := range config.Profiles {
+		_p.ID = strings.TrimSpace(_p.ID)
+		if _p.ID == "" {
+			_p.ID = fmt.Sprintf("profile-%d", i+1)
+		}
+		if _seen[_p.ID] {
+			logWarnf("Duplicate profile id %q, ignoring it.", _p.ID)
+			continue
+		}
+		_seen[_p.ID] = true
+
+		if _p.ApiKey == "" {
+			_p.ApiKey = config.ApiKey
+		}
+		if _p.AuthMode == "" {
+			_p.AuthMode = config.AuthMode
+		}
+		if _p.Host == "" {
+			_p.Host = config.Host
+		}
+		if _p.Name == "" && len(config.Profiles) == 1 {
+			_p.Name = config.Name
+		}
+		if _p.TLS == nil {
+			_p.TLS = config.TLS
+		}
+		if _p.MQTT == nil {
+			_p.MQTT = config.MQTT
+		}
+
+		if _p.Ports == nil {
+			_p.Ports = config.Ports
+		}
+		if _p.Ports == nil {
+			logWarnf("No \"ports\" section for profile %q, every local port is reachable.", _p.ID)
+		}
+		if _p.Targets == nil {
+			_p.Targets = config.Targets
+		}
+
+		_profiles = append(_profiles, _p)
+	}
+	config.Profiles = _profiles
+}
+
+// -------------------------
+// applyProfiles 依設定建立執行中的 Profile；重新載入時比對每個 profile 的差異並即時套用
+// 新增的 profile 立即連線、移除的 profile 中斷連線，既有 profile 的轉發規則與 TLS 設定立即生效
+func applyProfiles(profiles []ProfileConfig) {
+	_current := runningProfiles()
+	_running := map[string]*Profile{}
+	for _, _p := range _current {
+		_running[_p.settings().ID] = _p
+	}
+	_reload := len(_current) > 0
+
+	// 沿用硬體 ID 的 profile (index 0) 仍存在時，新增的 profile 不可再使用 index 0
+	_primaryKept := false
+	for _, _pc := range profiles {
+		if _p, ok := _running[_pc.ID]; ok && _p.index == 0 {
+			_primaryKept = true
+		}
+	}
+
+	_list := make([]*Profile, 0, len(profiles))
+	for i, _pc := range profiles {
+		// 建立伺服器 TLS 設定，設定錯誤時仍以系統 CA 驗證，不會退回不驗證
+		_tlsConfig, err := buildServerTLSConfig(_pc.TLS)
+		if err != nil {
+			logWarnf("Invalid tls settings in profile %q: %v. Using system CA verification.", _pc.ID, err)
+			_tlsConfig = &tls.Config{}
+		} else if _tlsConfig.InsecureSkipVerify {
+			logWarnf("tls.insecure is enabled for profile %q, server certificates are NOT verified.", _pc.ID)
+		}
+
+		_profile, ok := _running[_pc.ID]
+		if !ok {
+			_profile = &Profile{index: i, serverTLS: _tlsConfig}
+			_profile.config.Store(&_pc)
+			if _reload && i == 0 && _primaryKept {
+				_profile.index = len(profiles) + len(_current)
+			}
+			_list = append(_list, _profile)
+			if _reload {
+				_profile.log().Infof("Profile %q was added, connecting...", _pc.ID)
+				go _profile.start()
+			}
+			continue
+		}
+		delete(_running, _pc.ID)
+
+		_old := *_profile.settings()
+		_profile.config.Store(&_pc)
+		_profile.lock.Lock()
+		_profile.serverTLS = _tlsConfig
+		_profile.lock.Unlock()
+		_list = append(_list, _profile)
+
+		if _reload {
+			_profile.applyChanges(_old)
+		}
+	}
+
+	Global.profiles.Store(&_list)
+
+	// 已移除的 profile 關閉連線並發布下線狀態
+	for _id, _profile := range _running {
+		logInfof("Profile %q was removed, disconnecting...", _id)
+		go _profile.stop("removed from config")
+	}
+}
+
+// -------------------------
+// applyChanges 套用重新載入後的差異：
+// host、tls、mqtt 或 auth_mode 變更時關閉該 profile 的連線並重新註冊、重建 MQTT 連線；
+// api_key 或 name 變更時重新註冊，分配到不同 ID 才重建 MQTT 連線；
+// ports 或 targets 變更時只關閉不再允許的連線
+func (_this *Profile) applyChanges(old ProfileConfig) {
+	_new := *_this.settings()
+	_log := _this.log()
+
+	switch {
+	case old.Host != _new.Host || !reflect.DeepEqual(old.TLS, _new.TLS) || !reflect.DeepEqual(old.MQTT, _new.MQTT) ||
+		old.authMode() != _new.authMode():
+		_log.Infof("Server settings changed, reconnecting to %s...", _new.Host)
+		go func() {
+			if _closed := _this.closeSessions(); _closed > 0 {
+				_log.Infof("Closed %d session(s) of the previous server.", _closed)
+			}
+			_this.stop("server changed")
+			_this.start()
+		}()
+		return
+
+	case old.ApiKey != _new.ApiKey || old.Name != _new.Name:
+		_log.Infof("Identity settings changed, registering again...")
+		go _this.reregister()
+	}
+
+	if !reflect.DeepEqual(old.Ports, _new.Ports) || !reflect.DeepEqual(old.Targets, _new.Targets) {
+		if _closed := _this.closeDisallowedSessions(); _closed > 0 {
+			_log.Infof("Port policy updated, closed %d session(s) that are no longer allowed.", _closed)
+		} else {
+			_log.Infof("Port policy updated.")
+		}
+	}
+}
+
+// -------------------------
+// start 向伺服器領取 ID 並建立 MQTT 連線
+func (_this *Profile) start() {
+	_hardwareID := getHardwareID()
+	if _hardwareID == "" {
+		_this.log().Errorf("Failed to generate local hardware ID.")
+		return
+	}
+	_this.initHWID(_hardwareID)
+	_this.createTunnel()
+}
+
+// -------------------------
+// stop 發布下線狀態並中斷 MQTT 連線
+func (_this *Profile) stop(reason string) {
+	_this.lock.Lock()
+	_client := _this.client
+	_this.client = nil
+	_this.lock.Unlock()
+
+	if _client != nil {
+		_this.publishStatus(_client, statusOffline, reason)
+		_client.Disconnect(250)
+	}
+	_this.closeMux()
+}
+
+// -------------------------
+// reregister 以新的 api_key 或 name 重新向伺服器註冊
+// 分配到的 ID 不變時保留目前的 MQTT 連線與進行中的連線；註冊失敗時維持原本的 ID
+func (_this *Profile) reregister() {
+	_log := _this.log()
+	_hardwareID := getHardwareID()
+	if _hardwareID == "" {
+		_log.Errorf("Failed to generate local hardware ID.")
+		return
+	}
+
+	_id := _this.getAssignedID(_this.localHWID(_hardwareID))
+	switch {
+	case _id == "":
+		_log.Errorf("Registration failed, keeping ID %q.", _this.assignedID())
+	case _id == _this.assignedID():
+		_log.Infof("Registration updated, ID %s is unchanged.", _id)
+	default:
+		_log.Infof("Assigned ID changed from %q to %s, reconnecting...", _this.assignedID(), _id)
+		_this.stop("id changed")
+		_this.setAssignedID(_id)
+		_this.createTunnel()
+	}
+}
+
+// -------------------------
+// primaryProfile 回傳第一個 profile，GUI、自動更新等只需單一身分的功能使用
+func primaryProfile() *Profile {
+	_profiles := runningProfiles()
+	if len(_profiles) == 0 {
+		_profile := &Profile{}
+		_profile.config.Store(&ProfileConfig{ID: defaultProfileID, Host: defaultHost})
+		return _profile
+	}
+	return _profiles[0]
+}
+
+// -------------------------
+// settings 回傳目前的 profile 設定，重新載入時整個替換，呼叫端不可修改
+func (_this *Profile) settings() *ProfileConfig {
+	return _this.config.Load()
+}
+
+// -------------------------
+// assignedID 回傳伺服器分配的 ID，尚未註冊時為空字串
+func (_this *Profile) assignedID() string {
+	if _id := _this.hwID.Load(); _id != nil {
+		return *_id
+	}
+	return ""
+}
+
+// -------------------------
+func (_this *Profile) setAssignedID(id string) {
+	_this.hwID.Store(&id)
+}
+
+// -------------------------
+// findProfile 依 ID 尋找執行中的 profile
+func findProfile(id string) *Profile {
+	for _, _p := range runningProfiles() {
+		if _p.settings().ID == id {
+			return _p
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// localHWID 回傳向伺服器註冊用的本機 ID
+// 第一個 profile 沿用硬體 ID，其餘 profile 以硬體 ID 與 profile 名稱衍生，避免同一個 api_key 分配到相同 ID
+func (_this *Profile) localHWID(hardwareID string) string {
+	if _this.index == 0 {
+		return hardwareID
+	}
+	_hash := sha256.Sum256([]byte(hardwareID + "/" + _this.settings().ID))
+	return hex.EncodeToString(_hash[:])[:12]
+}
+
+// -------------------------
+// log 回傳 profile 的日誌，只有多個 profile 時才附上 profile 欄位
+func (_this *Profile) log() *sessionLogger {
+	if len(runningProfiles()) > 1 {
+		return newLog("profile", _this.settings().ID)
+	}
+	return newLog()
+}
+
+// -------------------------
+// sessionLog 建立附帶 SessionID 的日誌
+func (_this *Profile) sessionLog(session string) *sessionLogger {
+	return _this.log().With("session", session)
+}
+
+// -------------------------
+// tunnelLog 建立附帶隧道 Token 的日誌
+func (_this *Profile) tunnelLog(token string) *sessionLogger {
+	return _this.log().With("tunnel", shortToken(token))
+}
+
+// -------------------------
+// mqttClient 回傳目前的 MQTT 連線
+func (_this *Profile) mqttClient() mqtt.Client {
+	_this.lock.RLock()
+	defer _this.lock.RUnlock()
+	return _this.client
+}
+
+// -------------------------
+// connected 回傳 MQTT 連線是否開啟
+func (_this *Profile) connected() bool {
+	_client := _this.mqttClient()
+	return _client != nil && _client.IsConnectionOpen()
+}
+
+// -------------------------
+// mqttAlive 回傳是否有 profile 的 MQTT 連線仍在運作 (已連線，或中斷後由自動重連處理中)
+func mqttAlive() bool {
+	for _, _p := range runningProfiles() {
+		if _client := _p.mqttClient(); _client != nil && _client.IsConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------------
+// publicURL 回傳公網存取網址
+func (_this *Profile) publicURL() string {
+	return fmt.Sprintf("%s/pass/%s/", strings.TrimSuffix(_this.settings().Host, "/"), _this.assignedID())
+}
+
+// -------------------------
+// initHWID 為每個 profile 向伺服器領取分配的 ID
+func initHWID() {
+	_hardwareID := getHardwareID()
+	if _hardwareID == "" {
+		logErrorf("Failed to generate local hardware ID. Exiting...")
+		return
+	}
+
+	for _, _profile := range runningProfiles() {
+		_profile.initHWID(_hardwareID)
+	}
+}
+
+// -------------------------
+// createTunnels 為每個 profile 建立 MQTT 連線
+func createTunnels() {
+	for _, _profile := range runningProfiles() {
+		go _profile.createTunnel()
+	}
+}
+
+// -------------------------
+// reconnectTunnels 重新建立所有 profile 的 MQTT 連線
+func reconnectTunnels() {
+	for _, _profile := range runningProfiles() {
+		go _profile.reconnectTunnel()
+	}
+}
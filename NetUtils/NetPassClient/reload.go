@@ -0,0 +1,120 @@
+package main
+
+// -------------------------
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// -------------------------
+// 設定檔變更後等待的時間，編輯器存檔時常連續觸發多個事件
+const configReloadDelay = 500 * time.Millisecond
+
+// -------------------------
+var reloadLock sync.Mutex
+
+// -------------------------
+// reloadConfig 重新讀取設定並即時套用，設定有誤時保留目前的設定並回傳錯誤
+func reloadConfig(source string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	logInfof("Reloading configuration (%s)...", source)
+	_config, err := readConfig()
+	if err != nil {
+		logConfigError(err)
+		logWarnf("Configuration not reloaded, keeping the current settings.")
+		metricConfigReloads.Inc("error")
+		return err
+	}
+
+	_old := *currentConfig()
+	applyConfig(_config)
+	if _old.Log != _config.Log {
+		initLogging(_config.Log, cli.daemon)
+	}
+	warnRestartRequired(_old, _config)
+
+	metricConfigReloads.Inc("ok")
+	logInfof("Configuration reloaded.")
+	return nil
+}
+
+// -------------------------
+// warnRestartRequired 提示只在啟動時生效的設定
+func warnRestartRequired(old Config, config Config) {
+	_fields := []struct {
+		name    string
+		changed bool
+	}{
+		{"admin.listen", old.Admin.Listen != config.Admin.Listen},
+		{"metrics.listen", old.Metrics.Listen != config.Metrics.Listen},
+		{"instance", old.instanceName() != config.instanceName()},
+		{"auto_update", old.AutoUpdate != config.AutoUpdate},
+		{"update_interval", old.UpdateInterval != config.UpdateInterval},
+		{"identity_file", old.identityPath() != config.identityPath()},
+	}
+	for _, _f := range _fields {
+		if _f.changed {
+			logWarnf("%s changed. Restart the client to apply it.", _f.name)
+		}
+	}
+}
+
+// -------------------------
+// watchConfig 監看設定檔所在的目錄，設定檔寫入、建立或被取代時重新載入
+// 監看目錄而不是檔案本身，編輯器以改名方式存檔時仍能收到事件
+func watchConfig() {
+	_path, err := filepath.Abs(configPath)
+	if err != nil {
+		logWarnf("Cannot watch %s: %v", configPath, err)
+		return
+	}
+
+	_watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logWarnf("Cannot watch %s: %v", _path, err)
+		return
+	}
+	if err := _watcher.Add(filepath.Dir(_path)); err != nil {
+		logWarnf("Cannot watch %s: %v", _path, err)
+		_watcher.Close()
+		return
+	}
+	logInfof("Watching %s for changes", _path)
+
+	go func() {
+		var _timer *time.Timer
+		for {
+			select {
+			case _event, ok := <-_watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(_event.Name) != _path || !_event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if _timer != nil {
+					_timer.Stop()
+				}
+				_timer = time.AfterFunc(configReloadDelay, func() {
+					// 改名存檔的過程中檔案可能暫時不存在，等待新檔案建立的事件
+					if _, err := os.Stat(_path); err != nil {
+						return
+					}
+					reloadConfig("config file changed")
+				})
+
+			case err, ok := <-_watcher.Errors:
+				if !ok {
+					return
+				}
+				logWarnf("Config watcher error: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,106 @@
+package main
+
+// -------------------------
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// -------------------------
+var stopOnce sync.Once
+
+// stopLock 保護 restarting 與 exitRequested，重新啟動與關閉同時發生時以關閉為準
+var stopLock sync.Mutex
+var restarting bool    // 已開始重新啟動
+var exitRequested bool // 已要求結束程式，不再重新啟動
+
+// -------------------------
+// restartSelf 排空進行中的連線、中斷 MQTT 後以相同參數重新啟動 execPath
+// 背景模式的子進程本身帶有 -d 參數，重新啟動後仍維持背景模式
+// 服務管理員會收到 RELOADING=1，新的進程啟動完成後回報 READY=1；排空期間收到關閉要求時直接結束
+func restartSelf(execPath string, reason string) {
+	stopLock.Lock()
+	if restarting || exitRequested {
+		stopLock.Unlock()
+		logWarnf("Already stopping, not restarting (%s).", reason)
+		return
+	}
+	restarting = true
+	stopLock.Unlock()
+
+	logInfof("Restarting (%s). Draining active sessions...", reason)
+	serviceReloading()
+	stopClient(reason)
+
+	// 持有 stopLock 直到重新啟動，關閉要求不會在檢查後插入
+	stopLock.Lock()
+	if exitRequested {
+		// 由關閉流程結束程式
+		stopLock.Unlock()
+		select {}
+	}
+	releaseInstanceLock()
+	if err := execSelf(execPath); err != nil {
+		logErrorf("Restart failed: %v. Exiting...", err)
+		os.Exit(1)
+	}
+}
+
+// -------------------------
+// shutdown 排空進行中的連線、中斷 MQTT 後結束程式，重新啟動的排空期間呼叫時改為結束程式
+func shutdown(reason string) {
+	requestExit()
+	logInfof("Shutting down (%s). Draining active sessions...", reason)
+	serviceStopping()
+	stopClient(reason)
+	os.Exit(0)
+}
+
+// -------------------------
+// requestExit 標記程式即將結束，之後不再重新啟動
+func requestExit() {
+	stopLock.Lock()
+	exitRequested = true
+	stopLock.Unlock()
+}
+
+// -------------------------
+// stopClient 在 shutdown_grace 內等待進行中的連線結束，發布下線狀態後中斷 MQTT
+// 同時有多個關閉來源 (訊號、管理 API、更新) 時只執行一次，其餘呼叫等待其完成
+func stopClient(reason string) {
+	stopOnce.Do(func() {
+		if !drainSessions(currentConfig().shutdownGrace()) {
+			logWarnf("Drain timed out, remaining sessions were closed.")
+		}
+
+		for _, _profile := range runningProfiles() {
+			_profile.stop(reason)
+		}
+	})
+}
+
+// -------------------------
+// handleSignals 收到 SIGTERM / SIGINT 時優雅關閉，排空期間再收到一次則立即結束；收到 SIGHUP 時重新載入設定
+func handleSignals() {
+	_signals := make(chan os.Signal, 2)
+	signal.Notify(_signals, os.Interrupt, syscall.SIGTERM)
+
+	_reload := make(chan os.Signal, 1)
+	signal.Notify(_reload, syscall.SIGHUP)
+	go func() {
+		for range _reload {
+			reloadConfig("signal hangup")
+		}
+	}()
+
+	go func() {
+		_sig := <-_signals
+		go shutdown("signal " + _sig.String())
+
+		_sig = <-_signals
+		logWarnf("Received %s again, exiting immediately.", _sig)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// -------------------------
+import (
+	"os"
+	"syscall"
+)
+
+// -------------------------
+// execSelf 以新的執行檔取代目前進程，PID 與參數保持不變
+func execSelf(execPath string) error {
+	return syscall.Exec(execPath, os.Args, os.Environ())
+}
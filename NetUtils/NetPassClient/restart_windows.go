@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package main
+
+// -------------------------
+import (
+	"os"
+	"os/exec"
+)
+
+// -------------------------
+// execSelf 在 Windows 上無法取代目前進程，改為以相同參數啟動新進程後結束
+func execSelf(execPath string) error {
+	// 以服務執行時直接結束，由 SCM 依復原設定以新的執行檔重新啟動
+	if serviceManager() != "" {
+		os.Exit(1)
+	}
+
+	cmd := exec.Command(execPath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
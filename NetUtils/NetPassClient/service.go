@@ -0,0 +1,95 @@
+package main
+
+// -------------------------
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// -------------------------
+// serviceSpec 描述要註冊到服務管理員的實例
+type serviceSpec struct {
+	name        string   // 服務名稱，例如 netpass-office
+	description string   // 顯示名稱
+	exec        string   // 執行檔絕對路徑
+	args        []string // 執行參數，固定以 run --config <絕對路徑> 啟動
+	workDir     string   // 工作目錄 (設定檔所在目錄)
+	stopTimeout time.Duration
+}
+
+// -------------------------
+// newServiceSpec 依目前的設定檔與實例名稱建立服務描述
+// -host、-name 會一併寫入服務參數；-api-key 不會寫入，避免金鑰出現在其他使用者可讀取的服務定義中
+func newServiceSpec() (serviceSpec, error) {
+	_exec, err := os.Executable()
+	if err != nil {
+		return serviceSpec{}, err
+	}
+	if _resolved, err := filepath.EvalSymlinks(_exec); err == nil {
+		_exec = _resolved
+	}
+	_config, err := filepath.Abs(configPath)
+	if err != nil {
+		return serviceSpec{}, err
+	}
+	if _, err := os.Stat(_config); err != nil {
+		return serviceSpec{}, fmt.Errorf("config file %s: %w", _config, err)
+	}
+
+	_args := []string{"run", "-config", _config}
+	if cli.host != "" {
+		_args = append(_args, "-host", cli.host)
+	}
+	if cli.name != "" {
+		_args = append(_args, "-name", cli.name)
+	}
+	if cli.apiKey != "" {
+		logWarnf("-api-key is not stored in the service definition. Put api_key in %s or set NETPASS_API_KEY for the service.", _config)
+	}
+
+	_instance := currentConfig().instanceName()
+	return serviceSpec{
+		name:        "netpass-" + _instance,
+		description: fmt.Sprintf("NetPass Client (%s)", _instance),
+		exec:        _exec,
+		args:        _args,
+		workDir:     filepath.Dir(_config),
+		stopTimeout: currentConfig().shutdownGrace() + 10*time.Second,
+	}, nil
+}
+
+// -------------------------
+// cmdInstallService 註冊並啟動服務，加上 -print 時只輸出服務定義
+func cmdInstallService(opts cliOptions) int {
+	_spec, err := newServiceSpec()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if opts.print {
+		fmt.Print(serviceDefinition(_spec))
+		return 0
+	}
+
+	if err := installService(_spec); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to install service %s: %v\n", _spec.name, err)
+		return 1
+	}
+	fmt.Printf("Service %s installed and started.\n", _spec.name)
+	return 0
+}
+
+// -------------------------
+// cmdUninstallService 停止並移除服務
+func cmdUninstallService() int {
+	_name := "netpass-" + currentConfig().instanceName()
+	if err := uninstallService(_name); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to uninstall service %s: %v\n", _name, err)
+		return 1
+	}
+	fmt.Printf("Service %s removed.\n", _name)
+	return 0
+}
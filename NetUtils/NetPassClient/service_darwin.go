@@ -0,0 +1,147 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+// -------------------------
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// -------------------------
+const launchdDaemonDir = "/Library/LaunchDaemons"
+const launchdLabelPrefix = "com.mars-cloud."
+
+// -------------------------
+// serviceManager 回傳啟動本進程的服務管理員，不是由服務管理員啟動時回傳空字串
+// launchd 啟動的工作由 PID 1 啟動並帶有 XPC_SERVICE_NAME
+var serviceManager = sync.OnceValue(func() string {
+	if os.Getppid() == 1 && os.Getenv("XPC_SERVICE_NAME") != "" {
+		return "launchd"
+	}
+	return ""
+})
+
+// -------------------------
+// prepareService 在載入設定前調整服務執行環境，launchd 已依 plist 設定工作目錄
+func prepareService() {}
+
+// -------------------------
+// runService 由服務管理員控制生命週期，停止時透過 SIGTERM 觸發優雅關閉
+func runService(start func()) {
+	start()
+	select {}
+}
+
+// -------------------------
+// serviceReady launchd 沒有啟動完成通知
+func serviceReady() {}
+
+// -------------------------
+func serviceReloading() {}
+func serviceStopping()  {}
+
+// -------------------------
+func launchdPlistPath(name string) string {
+	return filepath.Join(launchdDaemonDir, launchdLabelPrefix+name+".plist")
+}
+
+// -------------------------
+func plistString(value string) string {
+	var _buf bytes.Buffer
+	xml.EscapeText(&_buf, []byte(value))
+	return "<string>" + _buf.String() + "</string>"
+}
+
+// -------------------------
+// serviceDefinition 回傳 launchd plist，非正常結束時由 launchd 重新啟動
+func serviceDefinition(spec serviceSpec) string {
+	_args := make([]string, 0, len(spec.args)+1)
+	for _, _arg := range append([]string{spec.exec}, spec.args...) {
+		_args = append(_args, "\t\t"+plistString(_arg))
+	}
+	_log := filepath.Join("/Library/Logs", spec.name+".log")
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!-- %s -->
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	%s
+	<key>ProgramArguments</key>
+	<array>
+%s
+	</array>
+	<key>WorkingDirectory</key>
+	%s
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ExitTimeOut</key>
+	<integer>%d</integer>
+	<key>StandardOutPath</key>
+	%s
+	<key>StandardErrorPath</key>
+	%s
+</dict>
+</plist>
+`, launchdPlistPath(spec.name), plistString(launchdLabelPrefix+spec.name), strings.Join(_args, "\n"),
+		plistString(spec.workDir), int(spec.stopTimeout.Seconds()), plistString(_log), plistString(_log))
+}
+
+// -------------------------
+// launchctl 執行 launchctl 並在失敗時附上輸出
+func launchctl(args ...string) error {
+	_output, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(_output)))
+	}
+	return nil
+}
+
+// -------------------------
+// installService 寫入 LaunchDaemon plist 並載入
+func installService(spec serviceSpec) error {
+	if os.Geteuid() != 0 {
+		return errors.New("root privileges are required (run with sudo, or use -print to write the plist yourself)")
+	}
+
+	_path := launchdPlistPath(spec.name)
+	if err := os.WriteFile(_path, []byte(serviceDefinition(spec)), 0644); err != nil {
+		return err
+	}
+
+	// 已載入時先卸載，讓新的 plist 生效
+	launchctl("bootout", "system/"+launchdLabelPrefix+spec.name)
+	return launchctl("bootstrap", "system", _path)
+}
+
+// -------------------------
+// uninstallService 卸載並移除 LaunchDaemon plist
+func uninstallService(name string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("root privileges are required (run with sudo)")
+	}
+
+	_path := launchdPlistPath(name)
+	if _, err := os.Stat(_path); err != nil {
+		return fmt.Errorf("%s is not installed", _path)
+	}
+	if err := launchctl("bootout", "system/"+launchdLabelPrefix+name); err != nil {
+		logWarnf("%v", err)
+	}
+	return os.Remove(_path)
+}
@@ -0,0 +1,190 @@
+//go:build linux
+// +build linux
+
+package main
+
+// -------------------------
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+const systemdUnitDir = "/etc/systemd/system"
+
+// -------------------------
+// serviceManager 回傳啟動本進程的服務管理員，不是由服務管理員啟動時回傳空字串
+// Type=notify 的服務會帶有 NOTIFY_SOCKET；其他 systemd 服務由 PID 1 啟動並帶有 INVOCATION_ID
+var serviceManager = sync.OnceValue(func() string {
+	if os.Getenv("NOTIFY_SOCKET") != "" || (os.Getenv("INVOCATION_ID") != "" && os.Getppid() == 1) {
+		return "systemd"
+	}
+	return ""
+})
+
+// -------------------------
+// prepareService 在載入設定前調整服務執行環境，systemd 已依 unit 設定工作目錄
+func prepareService() {}
+
+// -------------------------
+// runService 由服務管理員控制生命週期，停止時透過 SIGTERM 觸發優雅關閉
+func runService(start func()) {
+	start()
+	select {}
+}
+
+// -------------------------
+// sdNotify 透過 NOTIFY_SOCKET 通知 systemd 目前狀態
+func sdNotify(state string) {
+	_socket := os.Getenv("NOTIFY_SOCKET")
+	if _socket == "" {
+		return
+	}
+	// @ 開頭代表 Linux 的 abstract socket
+	if strings.HasPrefix(_socket, "@") {
+		_socket = "\x00" + _socket[1:]
+	}
+
+	_conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: _socket, Net: "unixgram"})
+	if err != nil {
+		logDebugf("sd_notify failed: %v", err)
+		return
+	}
+	defer _conn.Close()
+	_conn.Write([]byte(state))
+}
+
+// -------------------------
+// serviceReady 通知 systemd 已啟動完成，並依 WatchdogSec 在 MQTT 連線仍運作時回報存活
+func serviceReady() {
+	sdNotify("READY=1\nSTATUS=Running as instance " + currentConfig().instanceName())
+
+	_usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || _usec <= 0 {
+		return
+	}
+	if _pid := os.Getenv("WATCHDOG_PID"); _pid != "" && _pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	// 以逾時的四分之一為間隔檢查，短暫重建連線時不會錯過回報
+	// 所有 profile 的 MQTT 連線都已失效 (不再自動重連) 時停止回報，由 systemd 重新啟動
+	_interval := time.Duration(_usec) * time.Microsecond / 4
+	logDebugf("systemd watchdog enabled, interval %s", _interval)
+	go func() {
+		for {
+			time.Sleep(_interval)
+			if mqttAlive() {
+				sdNotify("WATCHDOG=1")
+			} else {
+				logWarnf("No MQTT connection is alive, skipping the systemd watchdog notification.")
+			}
+		}
+	}()
+}
+
+// -------------------------
+// serviceReloading 通知 systemd 即將重新啟動 (更新或回復版本)，exec 後的新進程啟動完成時回報 READY=1
+func serviceReloading() {
+	sdNotify("RELOADING=1\nSTATUS=Restarting")
+}
+
+// -------------------------
+// serviceStopping 通知 systemd 開始關閉，排空連線的時間不會被視為無回應
+func serviceStopping() {
+	sdNotify("STOPPING=1")
+}
+
+// -------------------------
+// systemdQuote 以 systemd 接受的方式為含空白的參數加上引號
+func systemdQuote(args []string) string {
+	_quoted := make([]string, len(args))
+	for i, _arg := range args {
+		if strings.ContainsAny(_arg, " \t\"'\\") {
+			_arg = strconv.Quote(_arg)
+		}
+		_quoted[i] = _arg
+	}
+	return strings.Join(_quoted, " ")
+}
+
+// -------------------------
+// serviceDefinition 回傳 systemd unit，以 Type=notify 回報啟動完成並啟用 watchdog
+func serviceDefinition(spec serviceSpec) string {
+	return fmt.Sprintf(`# %s
+[Unit]
+Description=%s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+WorkingDirectory=%s
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=10
+TimeoutStopSec=%d
+WatchdogSec=60
+
+[Install]
+WantedBy=multi-user.target
+`, filepath.Join(systemdUnitDir, spec.name+".service"), spec.description, spec.workDir,
+		systemdQuote(append([]string{spec.exec}, spec.args...)), int(spec.stopTimeout.Seconds()))
+}
+
+// -------------------------
+// systemctl 執行 systemctl 並在失敗時附上輸出
+func systemctl(args ...string) error {
+	_output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(_output)))
+	}
+	return nil
+}
+
+// -------------------------
+// installService 寫入 systemd unit 並設定開機啟動
+func installService(spec serviceSpec) error {
+	if os.Geteuid() != 0 {
+		return errors.New("root privileges are required (run with sudo, or use -print to write the unit yourself)")
+	}
+
+	_path := filepath.Join(systemdUnitDir, spec.name+".service")
+	if err := os.WriteFile(_path, []byte(serviceDefinition(spec)), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", spec.name)
+}
+
+// -------------------------
+// uninstallService 停止服務並移除 systemd unit
+func uninstallService(name string) error {
+	if os.Geteuid() != 0 {
+		return errors.New("root privileges are required (run with sudo)")
+	}
+
+	_path := filepath.Join(systemdUnitDir, name+".service")
+	if _, err := os.Stat(_path); err != nil {
+		return fmt.Errorf("%s is not installed", _path)
+	}
+	if err := systemctl("disable", "--now", name); err != nil {
+		return err
+	}
+	if err := os.Remove(_path); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
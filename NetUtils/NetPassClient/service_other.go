@@ -0,0 +1,33 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package main
+
+// -------------------------
+import (
+	"errors"
+	"runtime"
+)
+
+// -------------------------
+func serviceManager() string  { return "" }
+func prepareService()         {}
+func runService(start func()) { start(); select {} }
+func serviceReady()           {}
+func serviceReloading()       {}
+func serviceStopping()        {}
+
+// -------------------------
+func serviceDefinition(spec serviceSpec) string {
+	return ""
+}
+
+// -------------------------
+func installService(spec serviceSpec) error {
+	return errors.New("service installation is not supported on " + runtime.GOOS)
+}
+
+// -------------------------
+func uninstallService(name string) error {
+	return errors.New("service installation is not supported on " + runtime.GOOS)
+}
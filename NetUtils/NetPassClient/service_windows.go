@@ -0,0 +1,166 @@
+//go:build windows
+// +build windows
+
+package main
+
+// -------------------------
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// -------------------------
+// serviceManager 回傳啟動本進程的服務管理員，不是由服務管理員啟動時回傳空字串
+var serviceManager = sync.OnceValue(func() string {
+	if _is, err := svc.IsWindowsService(); err == nil && _is {
+		return "windows"
+	}
+	return ""
+})
+
+// -------------------------
+// prepareService 服務的工作目錄為 System32，切換到設定檔所在目錄，並如同背景模式預設寫入 client.log
+func prepareService() {
+	if serviceManager() == "" {
+		return
+	}
+	if _path, err := filepath.Abs(configPath); err == nil {
+		os.Chdir(filepath.Dir(_path))
+	}
+	cli.daemon = true
+}
+
+// -------------------------
+// windowsService 處理服務控制管理員 (SCM) 的停止與參數變更要求
+type windowsService struct {
+	start func()
+}
+
+// -------------------------
+// 進入 dispatcher 後立即回報執行中，載入設定、等待實例鎖與檢查更新等啟動流程在背景執行
+func (_this *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const _accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: _accepts}
+	go _this.start()
+
+	for _req := range requests {
+		switch _req.Cmd {
+		case svc.Interrogate:
+			status <- _req.CurrentStatus
+		case svc.ParamChange:
+			// sc.exe control <name> paramchange 等同 SIGHUP
+			go reloadConfig("service paramchange")
+		case svc.Stop, svc.Shutdown:
+			_wait := currentConfig().shutdownGrace() + 5*time.Second
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(_wait.Milliseconds())}
+			requestExit()
+			stopClient("service stop")
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// -------------------------
+// runService 先將控制權交給 SCM 再執行 start，SCM 要求服務在 30 秒內進入 dispatcher，服務停止後結束程式
+// 獨立進程的服務不使用這裡的名稱，設定尚未載入也不影響
+func runService(start func()) {
+	if err := svc.Run("netpass-"+currentConfig().instanceName(), &windowsService{start: start}); err != nil {
+		logErrorf("Service failed: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// -------------------------
+// Windows 服務由 SCM 控制，不需要啟動完成通知
+func serviceReady()     {}
+func serviceReloading() {}
+func serviceStopping()  {}
+
+// -------------------------
+// windowsQuote 為含空白的參數加上引號
+func windowsQuote(args []string) string {
+	_quoted := make([]string, len(args))
+	for i, _arg := range args {
+		_quoted[i] = syscall.EscapeArg(_arg)
+	}
+	return strings.Join(_quoted, " ")
+}
+
+// -------------------------
+// serviceDefinition 回傳等效的 sc.exe 指令，供無法直接註冊時手動執行
+func serviceDefinition(spec serviceSpec) string {
+	_binPath := windowsQuote(append([]string{spec.exec}, spec.args...))
+	return fmt.Sprintf(`sc.exe create %s binPath= %s start= auto DisplayName= %s
+sc.exe failure %s reset= 86400 actions= restart/10000/restart/10000/restart/10000
+sc.exe start %s
+`, spec.name, syscall.EscapeArg(_binPath), syscall.EscapeArg(spec.description), spec.name, spec.name)
+}
+
+// -------------------------
+// installService 註冊為自動啟動的 Windows 服務，異常結束時由 SCM 重新啟動
+func installService(spec serviceSpec) error {
+	_manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%v (run from an elevated prompt)", err)
+	}
+	defer _manager.Disconnect()
+
+	if _service, err := _manager.OpenService(spec.name); err == nil {
+		_service.Close()
+		return fmt.Errorf("service %s already exists, run uninstall-service first", spec.name)
+	}
+
+	_service, err := _manager.CreateService(spec.name, spec.exec, mgr.Config{
+		DisplayName: spec.description,
+		Description: "Exposes local services through the NetPass tunnel.",
+		StartType:   mgr.StartAutomatic,
+	}, spec.args...)
+	if err != nil {
+		return err
+	}
+	defer _service.Close()
+
+	_restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 10 * time.Second}
+	if err := _service.SetRecoveryActions([]mgr.RecoveryAction{_restart, _restart, _restart}, 86400); err != nil {
+		logWarnf("Failed to set recovery actions: %v", err)
+	}
+	return _service.Start()
+}
+
+// -------------------------
+// uninstallService 停止並刪除 Windows 服務
+func uninstallService(name string) error {
+	_manager, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("%v (run from an elevated prompt)", err)
+	}
+	defer _manager.Disconnect()
+
+	_service, err := _manager.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer _service.Close()
+
+	// 等待服務排空連線後停止
+	if _status, err := _service.Control(svc.Stop); err == nil {
+		_deadline := time.Now().Add(currentConfig().shutdownGrace() + 10*time.Second)
+		for _status.State != svc.Stopped && time.Now().Before(_deadline) {
+			time.Sleep(500 * time.Millisecond)
+			if _status, err = _service.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return _service.Delete()
+}
@@ -0,0 +1,167 @@
+package main
+
+// -------------------------
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -------------------------
+const defaultShutdownGrace = 30 * time.Second
+
+// -------------------------
+var errDraining = errors.New("client is shutting down")
+
+// -------------------------
+// activeSession 記錄一個進行中的 HTTP 轉發或隧道連線
+type activeSession struct {
+	ID      uint64             `json:"id"`
+	Profile string             `json:"profile"`
+	Kind    string             `json:"kind"`    // http / websocket / tcp
+	Session string             `json:"session"` // Broker 的 SessionID 或隧道 Token
+	Target  string             `json:"target"`  // 本地 (或區網) 連線位址
+	Started time.Time          `json:"started"`
+	request HttpRequestPayload // 原始請求，設定變更時重新檢查是否仍允許
+	closer  func()
+}
+
+// -------------------------
+var sessionLock sync.Mutex
+var sessionSeq uint64
+var activeSessions = map[uint64]*activeSession{}
+var draining atomic.Bool
+
+// -------------------------
+// shutdownGrace 回傳關閉或重新啟動時等待進行中連線結束的時間
+func (_this *Config) shutdownGrace() time.Duration {
+	if _this.ShutdownGrace == "" {
+		return defaultShutdownGrace
+	}
+	_grace, err := time.ParseDuration(_this.ShutdownGrace)
+	if err != nil || _grace < 0 {
+		logWarnf("Invalid shutdown_grace %q, using %s", _this.ShutdownGrace, defaultShutdownGrace)
+		return defaultShutdownGrace
+	}
+	return _grace
+}
+
+// -------------------------
+// trackSession 登記進行中的連線，回傳結束時呼叫的函式
+// closer 用於排空逾時或設定變更後不再允許時強制關閉連線
+func trackSession(profile string, kind string, session string, target string, request HttpRequestPayload, closer func()) func() {
+	sessionLock.Lock()
+	sessionSeq++
+	_session := &activeSession{
+		ID:      sessionSeq,
+		Profile: profile,
+		Kind:    kind,
+		Session: session,
+		Target:  target,
+		Started: time.Now(),
+		request: request,
+		closer:  closer,
+	}
+	activeSessions[_session.ID] = _session
+	sessionLock.Unlock()
+
+	var _once sync.Once
+	return func() {
+		_once.Do(func() {
+			sessionLock.Lock()
+			delete(activeSessions, _session.ID)
+			sessionLock.Unlock()
+		})
+	}
+}
+
+// -------------------------
+// activeSessionCount 回傳進行中的連線數量
+func activeSessionCount() int {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	return len(activeSessions)
+}
+
+// -------------------------
+// isDraining 回傳是否已停止接受新的請求
+func isDraining() bool {
+	return draining.Load()
+}
+
+// -------------------------
+// drainSessions 停止接受新請求並等待進行中的連線結束，逾時則強制關閉剩餘連線
+func drainSessions(timeout time.Duration) bool {
+	draining.Store(true)
+	rejectQueued(errDraining)
+
+	_deadline := time.Now().Add(timeout)
+	for activeSessionCount() > 0 && time.Now().Before(_deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	sessionLock.Lock()
+	_remaining := make([]*activeSession, 0, len(activeSessions))
+	for _, _s := range activeSessions {
+		_remaining = append(_remaining, _s)
+	}
+	sessionLock.Unlock()
+
+	for _, _s := range _remaining {
+		if _s.closer != nil {
+			_s.closer()
+		}
+	}
+	return len(_remaining) == 0
+}
+
+// -------------------------
+// profileSessions 回傳 profile 進行中的連線
+func profileSessions(profile string) []*activeSession {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	var _list []*activeSession
+	for _, _s := range activeSessions {
+		if _s.Profile == profile {
+			_list = append(_list, _s)
+		}
+	}
+	return _list
+}
+
+// -------------------------
+// closeSessions 關閉 profile 所有進行中的連線，回傳關閉的數量
+func (_this *Profile) closeSessions() int {
+	_list := profileSessions(_this.settings().ID)
+	for _, _s := range _list {
+		if _s.closer != nil {
+			_s.closer()
+		}
+	}
+	return len(_list)
+}
+
+// -------------------------
+// closeDisallowedSessions 以目前的 ports 與 targets 重新檢查 profile 的連線
+// 不再允許、或目標已指向其他位址的連線立即關閉，其餘連線不受影響
+func (_this *Profile) closeDisallowedSessions() int {
+	_closed := 0
+	for _, _s := range profileSessions(_this.settings().ID) {
+		_host, _port, err := _this.resolveTarget(_s.request, _s.Kind)
+		if err == nil && net.JoinHostPort(_host, _port) == _s.Target {
+			continue
+		}
+		if err == nil {
+			err = errors.New("target address changed")
+		}
+		_this.log().With("session", _s.Session).Infof("Closing %s session to %s: %v", _s.Kind, _s.Target, err)
+		if _s.closer != nil {
+			_s.closer()
+		}
+		_closed++
+	}
+	return _closed
+}
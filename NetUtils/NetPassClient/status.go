@@ -0,0 +1,53 @@
+package main
+
+// -------------------------
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// -------------------------
+const statusOnline = "online"
+const statusOffline = "offline"
+
+// -------------------------
+// StatusPayload 是發布到 http/status/<ID> 的上下線狀態 (Retained)
+type StatusPayload struct {
+	HardwareID string `json:"hw_id"`
+	Status     string `json:"status"` // online / offline
+	Version    string `json:"version"`
+	Reason     string `json:"reason,omitempty"` // 下線原因，例如 signal、admin request、update
+	Time       int64  `json:"time"`             // Unix 秒
+}
+
+// -------------------------
+func (_this *Profile) statusTopic() string {
+	return fmt.Sprintf("http/status/%s", _this.assignedID())
+}
+
+// -------------------------
+func (_this *Profile) statusMessage(status string, reason string) []byte {
+	_data, _ := json.Marshal(StatusPayload{
+		HardwareID: _this.assignedID(),
+		Status:     status,
+		Version:    defaultVersion,
+		Reason:     reason,
+		Time:       time.Now().Unix(),
+	})
+	return _data
+}
+
+// -------------------------
+// publishStatus 發布上下線狀態，等待 Broker 確認以確保中斷連線前已送出
+func (_this *Profile) publishStatus(client mqtt.Client, status string, reason string) {
+	if client == nil || !client.IsConnectionOpen() {
+		return
+	}
+	token := client.Publish(_this.statusTopic(), 1, true, _this.statusMessage(status, reason))
+	if !token.WaitTimeout(3*time.Second) || token.Error() != nil {
+		_this.log().Warnf("Failed to publish %s status: %v", status, token.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// -------------------------
+import (
+	"encoding/base64"
+	"io"
+)
+
+// -------------------------
+const defaultStreamThreshold = 512 * 1024
+const defaultStreamChunkSize = 256 * 1024
+
+// -------------------------
+// streamThreshold 回傳改用分段回傳的回應大小門檻
+func (_this *Config) streamThreshold() int64 {
+	if _this.StreamThreshold > 0 {
+		return _this.StreamThreshold
+	}
+	return defaultStreamThreshold
+}
+
+// -------------------------
+// streamChunkSize 回傳每段回應的大小
+func (_this *Config) streamChunkSize() int {
+	if _this.StreamChunkSize > 0 {
+		return _this.StreamChunkSize
+	}
+	return defaultStreamChunkSize
+}
+
+// -------------------------
+// readCloser 組合已讀取的開頭內容與原本的 Body，關閉時關閉原本的 Body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// -------------------------
+// markBase64 在 Header 中註明 Body 為 Base64 格式
+func markBase64(header map[string][]string, contentType string) {
+	header["Content-Transfer-Encoding"] = []string{"base64"}
+	if contentType != "" {
+		header["Content-Type"] = []string{contentType + "; base64"}
+	}
+}
+
+// -------------------------
+// streamResponse 將大型或長時間的回應切成有序的分段發布到回應主題
+// 第一段 (Seq 0) 帶有狀態碼與 Header，最後一段標記 Final，伺服器依 SessionID 與 Seq 重組
+// flush 為 true 時 (例如 Server-Sent Events) 每次讀到資料就立即送出，不等待填滿整段
+// 結束後呼叫 cleanup 取消本地請求並解除連線登記
+func (_this *Profile) streamResponse(head HttpResponsePayload, body io.ReadCloser, flush bool, cleanup func()) {
+	defer cleanup()
+	defer body.Close()
+
+	// 分段內容一律以 Base64 傳送，避免切斷多位元組字元
+	if head.Header == nil {
+		head.Header = map[string][]string{}
+	}
+	_contentType := ""
+	if _values := head.Header["Content-Type"]; len(_values) > 0 {
+		_contentType = _values[0]
+	}
+	markBase64(head.Header, _contentType)
+
+	_buf := make([]byte, currentConfig().streamChunkSize())
+	_seq := 0
+	_total := 0
+
+	for {
+		var n int
+		var err error
+		if flush {
+			n, err = body.Read(_buf)
+		} else {
+			n, err = io.ReadFull(body, _buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+		}
+
+		// 空的讀取結果不需要送出 (第一段除外)
+		if n == 0 && err == nil && _seq > 0 {
+			continue
+		}
+
+		_chunk := HttpResponsePayload{
+			HardwareID: head.HardwareID,
+			SessionID:  head.SessionID,
+			Chunked:    true,
+			Seq:        _seq,
+		}
+		if _seq == 0 {
+			_chunk = head
+			_chunk.Chunked = true
+		}
+		_chunk.Body = base64.StdEncoding.EncodeToString(_buf[:n])
+		_total += n
+
+		if err != nil {
+			_chunk.Final = true
+			if err != io.EOF {
+				_this.sessionLog(head.SessionID).Warnf("Stream aborted after %d bytes: %v", _total, err)
+				_chunk.Status = "Error: " + err.Error()
+			}
+		}
+
+		_this.publishResponse(_chunk)
+		_seq++
+
+		if _chunk.Final {
+			return
+		}
+	}
+}
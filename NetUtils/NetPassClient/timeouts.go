@@ -0,0 +1,166 @@
+package main
+
+// -------------------------
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+// 轉發至本地服務的預設逾時，與舊版固定的 10 秒相同
+const defaultConnectTimeout = 10 * time.Second
+const defaultHeaderTimeout = 10 * time.Second
+const defaultTotalTimeout = 10 * time.Second
+
+// -------------------------
+// errLocalTimeout 表示本地服務未在 timeouts.total 內完成回應
+var errLocalTimeout = errors.New("local request timed out")
+
+// errCallerDeadline 表示公開端的呼叫者已放棄等待 (超過請求的 deadline)
+var errCallerDeadline = errors.New("caller deadline exceeded")
+
+// -------------------------
+// PortTimeouts 是單一 Port 的逾時設定，未設定的欄位沿用 timeouts 的值
+type PortTimeouts struct {
+	Connect string `json:"connect"`
+	Header  string `json:"header"`
+	Total   string `json:"total"`
+}
+
+// -------------------------
+// TimeoutConfig 定義轉發至本地服務的逾時，"0" 代表不限制
+type TimeoutConfig struct {
+	Connect string                  `json:"connect"` // 連線到本地服務的逾時，預設 10s
+	Header  string                  `json:"header"`  // 送出請求後等待回應 Header 的逾時，預設 10s
+	Total   string                  `json:"total"`   // 整個請求 (含讀取回應主體) 的逾時，預設 10s；改為分段串流回傳後不再計時
+	Ports   map[string]PortTimeouts `json:"ports"`   // 依本地 (或區網目標) Port 覆寫，例如 {"8080": {"total": "5m"}}
+}
+
+// -------------------------
+// localTimeouts 是解析後的逾時，0 代表不限制
+type localTimeouts struct {
+	connect time.Duration
+	header  time.Duration
+	total   time.Duration
+}
+
+// -------------------------
+// forPort 回傳指定 Port 適用的逾時
+func (_this *TimeoutConfig) forPort(port string) localTimeouts {
+	_timeouts := localTimeouts{connect: defaultConnectTimeout, header: defaultHeaderTimeout, total: defaultTotalTimeout}
+	if _this == nil {
+		return _timeouts
+	}
+
+	_timeouts.apply(_this.Connect, _this.Header, _this.Total)
+	if _port, ok := _this.Ports[strings.TrimSpace(port)]; ok {
+		_timeouts.apply(_port.Connect, _port.Header, _port.Total)
+	}
+	return _timeouts
+}
+
+// -------------------------
+// apply 以有設定的欄位覆寫目前的值 (格式已由 Validate 檢查)
+func (_this *localTimeouts) apply(connect string, header string, total string) {
+	for _, _f := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{connect, &_this.connect},
+		{header, &_this.header},
+		{total, &_this.total},
+	} {
+		if _f.value == "" {
+			continue
+		}
+		if _d, err := time.ParseDuration(_f.value); err == nil {
+			*_f.target = _d
+		}
+	}
+}
+
+// -------------------------
+// dialer 回傳套用連線逾時的 Dialer
+func (_this localTimeouts) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: _this.connect}
+}
+
+// -------------------------
+// requestTimer 是本地請求的整體逾時計時器，停止後不會再被啟動
+type requestTimer struct {
+	total   time.Duration
+	cancel  context.CancelCauseFunc
+	lock    sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// -------------------------
+// start 開始計時，total 為 0 (不限制)、已開始或已停止時不做任何事
+func (_this *requestTimer) start() {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	if _this.total <= 0 || _this.timer != nil || _this.stopped {
+		return
+	}
+	_this.timer = time.AfterFunc(_this.total, func() { _this.cancel(errLocalTimeout) })
+}
+
+// -------------------------
+// stop 停止計時 (回應開始串流或請求結束時)
+func (_this *requestTimer) stop() {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	_this.stopped = true
+	if _this.timer != nil {
+		_this.timer.Stop()
+	}
+}
+
+// -------------------------
+// localRequestError 依取消原因整理本地請求的錯誤，逾時回傳 504，其餘回傳 502
+func localRequestError(ctx context.Context, err error) (error, int) {
+	if _cause := context.Cause(ctx); _cause == errLocalTimeout || _cause == errCallerDeadline {
+		return _cause, http.StatusGatewayTimeout
+	}
+	var _netErr net.Error
+	if errors.As(err, &_netErr) && _netErr.Timeout() {
+		return err, http.StatusGatewayTimeout
+	}
+	return err, http.StatusBadGateway
+}
+
+// -------------------------
+// Validate 檢查逾時設定
+func (_this *TimeoutConfig) Validate() error {
+	if _this == nil {
+		return nil
+	}
+	_check := func(prefix string, connect string, header string, total string) error {
+		for _, _f := range []struct{ name, value string }{{"connect", connect}, {"header", header}, {"total", total}} {
+			if err := validateDuration(_f.value); err != nil {
+				return fmt.Errorf("%s.%s: %v", prefix, _f.name, err)
+			}
+		}
+		return nil
+	}
+
+	if err := _check("timeouts", _this.Connect, _this.Header, _this.Total); err != nil {
+		return err
+	}
+	for _port, _t := range _this.Ports {
+		if _, err := parsePort(_port); err != nil {
+			return fmt.Errorf("timeouts.ports: %v", err)
+		}
+		if err := _check("timeouts.ports."+_port, _t.Connect, _t.Header, _t.Total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+// -------------------------
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// -------------------------
+// TLSConfig 定義連線到 NetPass 伺服器 (MQTT、WSS 隧道、API 與更新) 時的憑證驗證方式
+type TLSConfig struct {
+	CAFile   string   `json:"ca_file"`   // 自訂 CA 憑證檔 (PEM)，自架伺服器使用
+	Pins     []string `json:"pins"`      // 伺服器公鑰 SPKI 的 SHA-256 雜湊 (格式為 sha256/<base64>)
+	Insecure bool     `json:"insecure"`  // 略過憑證驗證，僅供測試環境使用
+	CertFile string   `json:"cert_file"` // 用戶端憑證 (PEM)，伺服器或 Broker 要求 mTLS 時使用
+	KeyFile  string   `json:"key_file"`  // 用戶端憑證的私鑰 (PEM)
+}
+
+// -------------------------
+// buildServerTLSConfig 依設定建立連線伺服器用的 tls.Config
+func buildServerTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	_tlsConfig := &tls.Config{}
+	if cfg == nil {
+		return _tlsConfig, nil
+	}
+
+	if cfg.CAFile != "" {
+		_pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.ca_file: %v", err)
+		}
+		_pool, err := x509.SystemCertPool()
+		if err != nil || _pool == nil {
+			_pool = x509.NewCertPool()
+		}
+		if !_pool.AppendCertsFromPEM(_pem) {
+			return nil, fmt.Errorf("tls.ca_file: no certificates found in %s", cfg.CAFile)
+		}
+		_tlsConfig.RootCAs = _pool
+	}
+
+	var _pins [][]byte
+	for _, _pin := range cfg.Pins {
+		_raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(_pin), "sha256/"))
+		if err != nil || len(_raw) != sha256.Size {
+			return nil, fmt.Errorf("tls.pins: invalid pin %q", _pin)
+		}
+		_pins = append(_pins, _raw)
+	}
+
+	_tlsConfig.InsecureSkipVerify = cfg.Insecure
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("tls.cert_file: cert_file and key_file must be set together")
+		}
+		_cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.cert_file: %v", err)
+		}
+
+		// 每次交握時重新讀取憑證，憑證由外部輪替後不需重新啟動；讀取失敗時沿用先前的憑證
+		_certFile, _keyFile := cfg.CertFile, cfg.KeyFile
+		_tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_latest, err := tls.LoadX509KeyPair(_certFile, _keyFile)
+			if err != nil {
+				logWarnf("Failed to reload client certificate %s: %v", _certFile, err)
+				return &_cert, nil
+			}
+			return &_latest, nil
+		}
+	}
+
+	// 設定 Pin 時，憑證鏈中至少要有一張憑證的公鑰相符 (Insecure 模式下仍會檢查)
+	if len(_pins) > 0 {
+		_insecure := cfg.Insecure
+		_tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, _cert := range pinnedCertificates(cs, _insecure) {
+				_sum := sha256.Sum256(_cert.RawSubjectPublicKeyInfo)
+				for _, _pin := range _pins {
+					if string(_sum[:]) == string(_pin) {
+						return nil
+					}
+				}
+			}
+			return errors.New("server certificate does not match any configured pin")
+		}
+	}
+
+	return _tlsConfig, nil
+}
+
+// -------------------------
+// pinnedCertificates 回傳可與 Pin 比對的憑證
+// 伺服器送來的憑證清單未經驗證，可以夾帶任意憑證：已驗證時只比對驗證過的憑證鏈，
+// Insecure 模式只比對交握時證明持有私鑰的葉憑證
+func pinnedCertificates(cs tls.ConnectionState, insecure bool) []*x509.Certificate {
+	if insecure {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		return cs.PeerCertificates[:1]
+	}
+	var _certs []*x509.Certificate
+	for _, _chain := range cs.VerifiedChains {
+		_certs = append(_certs, _chain...)
+	}
+	return _certs
+}
+
+// -------------------------
+// serverTLSConfig 回傳連線伺服器用的 tls.Config 副本
+func (_this *Profile) serverTLSConfig() *tls.Config {
+	_this.lock.RLock()
+	defer _this.lock.RUnlock()
+	if _this.serverTLS == nil {
+		return &tls.Config{}
+	}
+	return _this.serverTLS.Clone()
+}
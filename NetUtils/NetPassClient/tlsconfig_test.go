@@ -0,0 +1,161 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// -------------------------
+// testCert 是測試用的憑證與私鑰
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// -------------------------
+// newTestCert 建立憑證，parent 為 nil 時建立自簽的 CA
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	_signer, _signerKey := _template, _key
+	if parent == nil {
+		_template.IsCA = true
+		_template.BasicConstraintsValid = true
+		_template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		_signer, _signerKey = parent.cert, parent.key
+	}
+	_der, err := x509.CreateCertificate(rand.Reader, _template, _signer, &_key.PublicKey, _signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_cert, err := x509.ParseCertificate(_der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: _cert, key: _key}
+}
+
+// -------------------------
+// pin 回傳憑證公鑰的 Pin 值
+func (_this *testCert) pin() string {
+	_sum := sha256.Sum256(_this.cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(_sum[:])
+}
+
+// -------------------------
+// handshake 以 chain 作為伺服器送出的憑證清單 (私鑰屬於第一張) 完成交握，回傳 Client 端的結果
+func handshake(t *testing.T, config *tls.Config, chain []*testCert) error {
+	t.Helper()
+	_server := &tls.Certificate{PrivateKey: chain[0].key}
+	for _, _c := range chain {
+		_server.Certificate = append(_server.Certificate, _c.cert.Raw)
+	}
+
+	// 以 TCP 連線交握，net.Pipe 沒有緩衝，雙方同時送出 Alert 與 Session Ticket 時會互相等待
+	_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer _listener.Close()
+	go func() {
+		_conn, err := _listener.Accept()
+		if err != nil {
+			return
+		}
+		defer _conn.Close()
+		tls.Server(_conn, &tls.Config{Certificates: []tls.Certificate{*_server}}).Handshake()
+	}()
+
+	_conn, err := net.DialTimeout("tcp", _listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer _conn.Close()
+	_conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_config := config.Clone()
+	_config.ServerName = "netpass.test"
+	return tls.Client(_conn, _config).Handshake()
+}
+
+// -------------------------
+func TestServerTLSPins(t *testing.T) {
+	_ca := newTestCert(t, "NetPass Test CA", nil)
+	_server := newTestCert(t, "netpass.test", _ca)
+	_attacker := newTestCert(t, "netpass.test", _ca)
+	_selfSigned := newTestCert(t, "netpass.test", nil)
+
+	_caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(_caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: _ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_tests := []struct {
+		name     string
+		insecure bool
+		pins     []string
+		chain    []*testCert
+		wantErr  bool
+	}{
+		{"verified leaf pin", false, []string{_server.pin()}, []*testCert{_server}, false},
+		{"verified ca pin", false, []string{_ca.pin()}, []*testCert{_server}, false},
+		{"verified chain does not match", false, []string{_server.pin()}, []*testCert{_attacker}, true},
+		{"verified forged chain carries pinned cert", false, []string{_server.pin()}, []*testCert{_attacker, _server}, true},
+		{"insecure leaf pin", true, []string{_selfSigned.pin()}, []*testCert{_selfSigned}, false},
+		{"insecure forged chain carries pinned cert", true, []string{_server.pin()}, []*testCert{_selfSigned, _server}, true},
+		{"insecure forged chain carries pinned ca", true, []string{_ca.pin()}, []*testCert{_selfSigned, _ca}, true},
+		{"insecure without pins", true, nil, []*testCert{_selfSigned}, false},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_config, err := buildServerTLSConfig(&TLSConfig{CAFile: _caFile, Pins: _tt.pins, Insecure: _tt.insecure})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = handshake(t, _config, _tt.chain)
+			if _tt.wantErr && err == nil {
+				t.Fatal("handshake succeeded, want a pin mismatch")
+			}
+			if !_tt.wantErr && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+		})
+	}
+}
+
+// -------------------------
+func TestServerTLSInvalidPin(t *testing.T) {
+	_tests := []string{"sha256/not base64!", "sha256/" + base64.StdEncoding.EncodeToString([]byte("short"))}
+	for _, _pin := range _tests {
+		if _, err := buildServerTLSConfig(&TLSConfig{Pins: []string{_pin}}); err == nil {
+			t.Fatalf("pin %q accepted", _pin)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// -------------------------
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+// 轉發至本地服務的連線重用預設值
+const defaultMaxIdleConns = 16
+const defaultIdleConnTimeout = 90 * time.Second
+
+// -------------------------
+// LocalHTTPConfig 定義轉發至本地服務的連線重用與 HTTP/2 設定
+type LocalHTTPConfig struct {
+	MaxIdleConns    int      `json:"max_idle_conns"`     // 每個目標保留的閒置連線上限，預設 16
+	MaxConnsPerHost int      `json:"max_conns_per_host"` // 每個目標同時開啟的連線上限，0 代表不限制
+	IdleConnTimeout string   `json:"idle_conn_timeout"`  // 閒置連線保留的時間，預設 90s
+	DisableHTTP2    bool     `json:"disable_http2"`      // 不與 HTTPS 服務協商 HTTP/2
+	H2CPorts        []string `json:"h2c_ports"`          // 以明文 HTTP/2 (h2c，prior knowledge) 連線的本地 Port
+	HTTPSPorts      []string `json:"https_ports"`        // 以 HTTPS 連線的本地 Port，http_tunnel 依此決定是否使用 TLS
+}
+
+// -------------------------
+// transportSettings 是建立 Transport 時使用的設定，設定變更時重新建立
+type transportSettings struct {
+	timeouts    localTimeouts
+	maxIdle     int
+	maxConns    int
+	idleTimeout time.Duration
+	http2       bool
+	h2c         bool
+}
+
+// -------------------------
+// cachedTransport 是某個目標共用的 Transport
+type cachedTransport struct {
+	settings  transportSettings
+	transport *http.Transport
+}
+
+// -------------------------
+var transportLock sync.Mutex
+var localTransports = map[string]*cachedTransport{}
+
+// -------------------------
+// settings 回傳指定 Port 適用的 Transport 設定
+func (_this *LocalHTTPConfig) settings(port string) transportSettings {
+	_settings := transportSettings{maxIdle: defaultMaxIdleConns, idleTimeout: defaultIdleConnTimeout, http2: true}
+	if _this == nil {
+		return _settings
+	}
+
+	if _this.MaxIdleConns > 0 {
+		_settings.maxIdle = _this.MaxIdleConns
+	}
+	_settings.maxConns = _this.MaxConnsPerHost
+	if _timeout, err := time.ParseDuration(_this.IdleConnTimeout); err == nil && _timeout > 0 {
+		_settings.idleTimeout = _timeout
+	}
+	_settings.http2 = !_this.DisableHTTP2
+	_settings.h2c = slices.Contains(_this.H2CPorts, strings.TrimSpace(port))
+	return _settings
+}
+
+// -------------------------
+// usesHTTPS 回傳指定 Port 是否設定為 HTTPS 服務
+func (_this *LocalHTTPConfig) usesHTTPS(port string) bool {
+	return _this != nil && slices.Contains(_this.HTTPSPorts, strings.TrimSpace(port))
+}
+
+// -------------------------
+// Validate 檢查本地連線設定
+func (_this *LocalHTTPConfig) Validate() error {
+	if _this == nil {
+		return nil
+	}
+	if _this.MaxIdleConns < 0 {
+		return errors.New("local_http.max_idle_conns: must not be negative")
+	}
+	if _this.MaxConnsPerHost < 0 {
+		return errors.New("local_http.max_conns_per_host: must not be negative")
+	}
+	if err := validateDuration(_this.IdleConnTimeout); err != nil {
+		return fmt.Errorf("local_http.idle_conn_timeout: %v", err)
+	}
+	for _, _port := range _this.H2CPorts {
+		if _, err := parsePort(_port); err != nil {
+			return fmt.Errorf("local_http.h2c_ports: %v", err)
+		}
+	}
+	for _, _port := range _this.HTTPSPorts {
+		if _, err := parsePort(_port); err != nil {
+			return fmt.Errorf("local_http.https_ports: %v", err)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// localTransport 回傳轉發至指定目標 (host:port) 共用的 Transport，保留連線供後續請求重用
+// 逾時或連線設定在重新載入後變更時，改用新的 Transport 並關閉舊的閒置連線
+func localTransport(address string, port string) *http.Transport {
+	_config := currentConfig()
+	_settings := _config.LocalHTTP.settings(port)
+	_settings.timeouts = _config.Timeouts.forPort(port)
+
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	_cached, ok := localTransports[address]
+	if ok && _cached.settings == _settings {
+		return _cached.transport
+	}
+	if ok {
+		_cached.transport.CloseIdleConnections()
+	}
+
+	_transport := newLocalTransport(_settings)
+	localTransports[address] = &cachedTransport{settings: _settings, transport: _transport}
+	return _transport
+}
+
+// -------------------------
+// newLocalTransport 建立支援 Insecure TLS 的 Transport
+// HTTPS 服務以 ALPN 協商 HTTP/2；h2c Port 則直接以明文 HTTP/2 連線
+func newLocalTransport(settings transportSettings) *http.Transport {
+	var _protocols http.Protocols
+	if settings.h2c {
+		_protocols.SetUnencryptedHTTP2(true)
+	} else {
+		_protocols.SetHTTP1(true)
+	}
+	_protocols.SetHTTP2(settings.http2)
+
+	return &http.Transport{
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		DialContext:           settings.timeouts.dialer().DialContext,
+		ResponseHeaderTimeout: settings.timeouts.header,
+		MaxIdleConnsPerHost:   settings.maxIdle,
+		MaxConnsPerHost:       settings.maxConns,
+		IdleConnTimeout:       settings.idleTimeout,
+		Protocols:             &_protocols,
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------------
+// updatePublicKey 是驗證更新檔簽章的 ed25519 公鑰 (Base64)
+// 編譯時以 -ldflags "-X main.updatePublicKey=..." 注入，或於 config.json 的 update_public_key 指定
+var updatePublicKey = ""
+
+// -------------------------
+// 新版啟動後必須在此時間內連上 Tunnel，否則自動還原為舊版
+const updateHealthTimeout = 2 * time.Minute
+
+// 新版連續啟動失敗超過此次數即還原為舊版
+const updateMaxAttempts = 3
+
+// 未設定 update_interval 時的背景檢查間隔
+const defaultUpdateInterval = 24 * time.Hour
+
+// -------------------------
+// UpdateManifest 定義更新端點回傳的版本資訊
+type UpdateManifest struct {
+	Version   string `json:"version"`   // 版本號，例如 0.2.14
+	URL       string `json:"url"`       // 執行檔下載位址 (可為相對路徑)
+	SHA256    string `json:"sha256"`    // 執行檔的 SHA-256 (hex)
+	Signature string `json:"signature"` // ed25519 簽章 (Base64)，內容見 signedMessage
+}
+
+// -------------------------
+// pendingUpdate 記錄尚未通過健康檢查的更新
+type pendingUpdate struct {
+	FromVersion string `json:"from_version"`
+	ToVersion   string `json:"to_version"`
+	Attempts    int    `json:"attempts"`
+	CountedBy   int    `json:"counted_by,omitempty"` // 計入最後一次啟動的進程 PID，fork 後的子進程不重複計算
+}
+
+// -------------------------
+// signedMessage 回傳簽章涵蓋的內容：版本、平台與檔案雜湊，避免被替換成其他平台或舊版的檔案
+func (_this *UpdateManifest) signedMessage() []byte {
+	return []byte(fmt.Sprintf("%s\n%s/%s\n%s", _this.Version, runtime.GOOS, runtime.GOARCH, strings.ToLower(_this.SHA256)))
+}
+
+// -------------------------
+// verify 以公鑰驗證 Manifest 簽章
+func (_this *UpdateManifest) verify(publicKey ed25519.PublicKey) error {
+	_sig, err := base64.StdEncoding.DecodeString(_this.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(publicKey, _this.signedMessage(), _sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// -------------------------
+// getUpdatePublicKey 取得驗證更新用的公鑰，設定檔優先於編譯時注入的值
+func getUpdatePublicKey() (ed25519.PublicKey, error) {
+	_encoded := strings.TrimSpace(currentConfig().UpdatePublicKey)
+	if _encoded == "" {
+		_encoded = strings.TrimSpace(updatePublicKey)
+	}
+	if _encoded == "" {
+		return nil, errors.New("no update public key configured")
+	}
+	_key, err := base64.StdEncoding.DecodeString(_encoded)
+	if err != nil || len(_key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid update public key")
+	}
+	return ed25519.PublicKey(_key), nil
+}
+
+// -------------------------
+// parseVersion 將 "Version 0.2.13" 或 "0.2.13" 轉為數字陣列
+func parseVersion(version string) []int {
+	_version := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(version), "Version"))
+	_version = strings.TrimPrefix(_version, "v")
+
+	var _parts []int
+	for _, _p := range strings.Split(_version, ".") {
+		_n, err := strconv.Atoi(strings.TrimSpace(_p))
+		if err != nil {
+			break
+		}
+		_parts = append(_parts, _n)
+	}
+	return _parts
+}
+
+// -------------------------
+// compareVersions 比較兩個版本號，a 較新回傳 1，相同回傳 0，較舊回傳 -1
+func compareVersions(a string, b string) int {
+	_a := parseVersion(a)
+	_b := parseVersion(b)
+	for i := 0; i < len(_a) || i < len(_b); i++ {
+		var _x, _y int
+		if i < len(_a) {
+			_x = _a[i]
+		}
+		if i < len(_b) {
+			_y = _b[i]
+		}
+		if _x != _y {
+			if _x > _y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// -------------------------
+// updateClient 建立連線到更新伺服器用的 HTTP Client
+func updateClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			TLSClientConfig: primaryProfile().serverTLSConfig(),
+		},
+	}
+}
+
+// -------------------------
+// fetchManifest 從更新端點取得版本資訊
+func fetchManifest(client *http.Client) (*UpdateManifest, error) {
+	_host := strings.TrimSuffix(primaryProfile().settings().Host, "/")
+	_manifestURL := fmt.Sprintf("%s/update/%s/%s/manifest", _host, runtime.GOOS, runtime.GOARCH)
+	if _channel := currentConfig().updateChannel(); _channel != "stable" {
+		_manifestURL += "?channel=" + _channel
+	}
+
+	_resp, err := client.Get(_manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer _resp.Body.Close()
+
+	if _resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("manifest request returned %d", _resp.StatusCode)
+	}
+
+	var _manifest UpdateManifest
+	if err := json.NewDecoder(io.LimitReader(_resp.Body, 1<<20)).Decode(&_manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if _manifest.Version == "" || _manifest.SHA256 == "" || _manifest.Signature == "" {
+		return nil, errors.New("manifest is missing version, sha256 or signature")
+	}
+
+	// 未指定下載位址時沿用舊版的更新路徑
+	if _manifest.URL == "" {
+		_manifest.URL = fmt.Sprintf("%s/update/%s/%s", _host, runtime.GOOS, runtime.GOARCH)
+	} else if strings.HasPrefix(_manifest.URL, "/") {
+		_manifest.URL = _host + _manifest.URL
+	}
+
+	return &_manifest, nil
+}
+
+// -------------------------
+// downloadUpdate 下載更新檔到臨時檔案並同時計算 SHA-256
+func downloadUpdate(client *http.Client, manifest *UpdateManifest, tmpPath string) error {
+	_resp, err := client.Get(manifest.URL)
+	if err != nil {
+		return err
+	}
+	defer _resp.Body.Close()
+
+	if _resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download returned %d", _resp.StatusCode)
+	}
+
+	_out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+
+	_hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(_out, _hash), _resp.Body)
+	_out.Close()
+	if err != nil {
+		return err
+	}
+
+	_sum := hex.EncodeToString(_hash.Sum(nil))
+	if !strings.EqualFold(_sum, manifest.SHA256) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", manifest.SHA256, _sum)
+	}
+	return nil
+}
+
+// -------------------------
+// installUpdate 保留舊版為 .bak 後換上新版
+// 先把執行中的檔案改名再放入新檔，Windows 上無法覆蓋執行中的 exe，但允許改名
+func installUpdate(execPath string, tmpPath string) error {
+	_backupPath := execPath + ".bak"
+	os.Remove(_backupPath)
+
+	if err := os.Rename(execPath, _backupPath); err != nil {
+		return fmt.Errorf("failed to back up executable: %v", err)
+	}
+	if err := os.Rename(tmpPath, execPath); err != nil {
+		// 放回舊版
+		os.Rename(_backupPath, execPath)
+		return fmt.Errorf("failed to replace executable: %v", err)
+	}
+	return nil
+}
+
+// -------------------------
+// checkUpdate 檢查並執行自動更新，只安裝簽章與雜湊皆正確的新版本
+func checkUpdate() {
+	_execPath, _err := os.Executable()
+	if _err != nil {
+		return
+	}
+
+	// 檢查是否為 go run 模式 (源碼執行)
+	if strings.Contains(_execPath, "go-build") || strings.Contains(_execPath, "/tmp/") {
+		logWarnf("Source code execution (go run) detected. Skipping auto-update.")
+		return
+	}
+
+	// 每次檢查都以錯誤等級記錄，缺少公鑰的執行檔不會默默停止更新
+	_publicKey, err := getUpdatePublicKey()
+	if err != nil {
+		logErrorf("Skipping auto-update: %v", err)
+		return
+	}
+
+	logInfof("Checking for updates...")
+	_client := updateClient()
+
+	_manifest, err := fetchManifest(_client)
+	if err != nil {
+		logErrorf("Update check failed: %v", err)
+		return
+	}
+
+	if compareVersions(_manifest.Version, defaultVersion) <= 0 {
+		logInfof("Already up to date.")
+		return
+	}
+
+	// 曾經還原過的版本不再重複安裝
+	if _failed, err := os.ReadFile(_execPath + ".failed-version"); err == nil && strings.TrimSpace(string(_failed)) == _manifest.Version {
+		logWarnf("Skipping version %s: it failed the health check before.", _manifest.Version)
+		return
+	}
+
+	if err := _manifest.verify(_publicKey); err != nil {
+		logWarnf("Rejected update %s: %v", _manifest.Version, err)
+		return
+	}
+
+	// 下載到臨時檔案並驗證雜湊
+	_tmpPath := _execPath + ".tmp"
+	if err := downloadUpdate(_client, _manifest, _tmpPath); err != nil {
+		logErrorf("Download failed: %v", err)
+		os.Remove(_tmpPath) // 清理臨時檔案
+		return
+	}
+
+	if err := installUpdate(_execPath, _tmpPath); err != nil {
+		logErrorf("%v", err)
+		os.Remove(_tmpPath) // 清理臨時檔案
+		return
+	}
+
+	// 記錄待確認的更新，新版啟動後通過健康檢查才算完成
+	writePendingUpdate(_execPath, pendingUpdate{
+		FromVersion: defaultVersion,
+		ToVersion:   _manifest.Version,
+	})
+
+	logInfof("Update %s installed.", _manifest.Version)
+	restartSelf(_execPath, "update to "+_manifest.Version)
+}
+
+// -------------------------
+// updateInterval 回傳背景檢查更新的間隔
+func (_this *Config) updateInterval() time.Duration {
+	if _this.UpdateInterval == "" {
+		return defaultUpdateInterval
+	}
+	_interval, err := time.ParseDuration(_this.UpdateInterval)
+	if err != nil || _interval < time.Minute {
+		logWarnf("Invalid update_interval %q, using %s", _this.UpdateInterval, defaultUpdateInterval)
+		return defaultUpdateInterval
+	}
+	return _interval
+}
+
+// -------------------------
+// updateChannel 回傳更新頻道 (stable / beta)
+func (_this *Config) updateChannel() string {
+	switch _channel := strings.ToLower(strings.TrimSpace(_this.UpdateChannel)); _channel {
+	case "", "stable":
+		return "stable"
+	case "beta":
+		return _channel
+	default:
+		logWarnf("Unknown update_channel %q, using stable", _this.UpdateChannel)
+		return "stable"
+	}
+}
+
+// -------------------------
+// startUpdateLoop 在背景定期檢查更新
+func startUpdateLoop() {
+	_interval := currentConfig().updateInterval()
+	go func() {
+		for {
+			time.Sleep(_interval)
+			checkUpdate()
+		}
+	}()
+}
+
+// -------------------------
+func writePendingUpdate(execPath string, pending pendingUpdate) {
+	_data, _ := json.Marshal(pending)
+	if err := os.WriteFile(execPath+".pending", _data, 0644); err != nil {
+		logErrorf("Failed to record pending update: %v", err)
+	}
+}
+
+// -------------------------
+// readPendingUpdate 讀取尚未通過健康檢查的更新，內容無法解析時刪除
+func readPendingUpdate(execPath string) (pendingUpdate, bool) {
+	var _pending pendingUpdate
+	_data, err := os.ReadFile(execPath + ".pending")
+	if err != nil {
+		return _pending, false
+	}
+	if json.Unmarshal(_data, &_pending) != nil {
+		os.Remove(execPath + ".pending")
+		return _pending, false
+	}
+	return _pending, true
+}
+
+// -------------------------
+// checkPendingUpdate 於啟動的第一步 (讀取設定前) 計算更新後的啟動次數，超過 updateMaxAttempts 時還原為 .bak
+// 新版在讀取設定或取得鎖定時就結束也會被計入；背景模式 fork 出的子進程由父進程計算過，不重複計算
+func checkPendingUpdate() {
+	_execPath, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	// 清理上次還原時無法刪除的檔案 (Windows)
+	os.Remove(_execPath + ".failed")
+
+	_pending, ok := readPendingUpdate(_execPath)
+	if !ok {
+		return
+	}
+
+	if _pending.CountedBy == 0 || _pending.CountedBy != os.Getppid() {
+		_pending.Attempts++
+		if _pending.Attempts > updateMaxAttempts {
+			rollbackUpdate(_execPath, _pending, fmt.Sprintf("failed to start %d times", updateMaxAttempts))
+			return
+		}
+	}
+	_pending.CountedBy = os.Getpid()
+	writePendingUpdate(_execPath, _pending)
+}
+
+// -------------------------
+// watchPendingUpdate 開始更新的健康檢查，新版必須在 updateHealthTimeout 內連上 Tunnel (confirmUpdate)，否則還原
+// 背景模式只在 fork 後的子進程呼叫
+func watchPendingUpdate() {
+	_execPath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	_pending, ok := readPendingUpdate(_execPath)
+	if !ok {
+		return
+	}
+
+	logInfof("Running updated version %s (attempt %d), waiting for health check...", _pending.ToVersion, _pending.Attempts)
+	time.AfterFunc(updateHealthTimeout, func() { checkUpdateHealth(_execPath, _pending, false) })
+}
+
+// -------------------------
+// checkUpdateHealth 在 updateHealthTimeout 後確認新版已連上 Tunnel，否則還原
+// 連不到伺服器的 MQTT Port 時 (網路中斷) 無法判斷新版是否正常，延後再檢查；網路恢復後再給一次完整的等待時間
+func checkUpdateHealth(execPath string, pending pendingUpdate, postponed bool) {
+	if _, err := os.Stat(execPath + ".pending"); err != nil {
+		return
+	}
+
+	_reachable := brokerReachable()
+	if !_reachable || postponed {
+		if !_reachable {
+			logWarnf("NetPass server is unreachable, postponing the update health check.")
+		}
+		time.AfterFunc(updateHealthTimeout, func() { checkUpdateHealth(execPath, pending, !_reachable) })
+		return
+	}
+	rollbackUpdate(execPath, pending, "no tunnel connection within "+updateHealthTimeout.String()+" while the server was reachable")
+}
+
+// -------------------------
+// brokerReachable 回傳是否能連到伺服器的 MQTT Port
+func brokerReachable() bool {
+	_address := net.JoinHostPort(primaryProfile().getTunnelHost(), "18883")
+	_conn, err := net.DialTimeout("tcp", _address, 10*time.Second)
+	if err != nil {
+		return false
+	}
+	_conn.Close()
+	return true
+}
+
+// -------------------------
+// confirmUpdate 在成功連上 Tunnel 後呼叫，確認新版運作正常
+func confirmUpdate() {
+	_execPath, err := os.Executable()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(_execPath + ".pending"); err == nil {
+		logInfof("Update health check passed.")
+	}
+}
+
+// -------------------------
+// rollbackUpdate 還原為更新前的版本並重新啟動
+func rollbackUpdate(execPath string, pending pendingUpdate, reason string) {
+	logErrorf("Update to %s failed (%s). Rolling back to %s...", pending.ToVersion, reason, pending.FromVersion)
+
+	_backupPath := execPath + ".bak"
+	if _, err := os.Stat(_backupPath); err != nil {
+		logErrorf("Rollback impossible, backup not found: %v", err)
+		os.Remove(execPath + ".pending")
+		return
+	}
+
+	// 執行中的檔案只能改名 (Windows)，待下次啟動再刪除
+	if err := os.Rename(execPath, execPath+".failed"); err != nil {
+		logErrorf("Rollback failed: %v", err)
+		return
+	}
+	if err := os.Rename(_backupPath, execPath); err != nil {
+		logErrorf("Rollback failed: %v", err)
+		os.Rename(execPath+".failed", execPath)
+		return
+	}
+	os.Remove(execPath + ".failed")
+	os.Remove(execPath + ".pending")
+	os.WriteFile(execPath+".failed-version", []byte(pending.ToVersion), 0644)
+
+	logInfof("Rollback completed.")
+	restartSelf(execPath, "rollback to "+pending.FromVersion)
+}
@@ -0,0 +1,93 @@
+package main
+
+// -------------------------
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// -------------------------
+func TestUpdateManifestVerify(t *testing.T) {
+	_public, _private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const _hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	_sign := func(message string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(_private, []byte(message)))
+	}
+	_platform := runtime.GOOS + "/" + runtime.GOARCH
+	_otherPlatform := "plan9/mips"
+	if _platform == _otherPlatform {
+		_otherPlatform = "linux/amd64"
+	}
+	_valid := _sign(fmt.Sprintf("0.2.14\n%s\n%s", _platform, _hash))
+
+	_tests := []struct {
+		name     string
+		manifest UpdateManifest
+		key      ed25519.PublicKey
+		want     string
+	}{
+		{"valid", UpdateManifest{Version: "0.2.14", SHA256: _hash, Signature: _valid}, _public, ""},
+		{"hash case is ignored", UpdateManifest{Version: "0.2.14", SHA256: "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08", Signature: _valid}, _public, ""},
+		{"url is not signed", UpdateManifest{Version: "0.2.14", URL: "https://mirror.example.com/netpass", SHA256: _hash, Signature: _valid}, _public, ""},
+		{"other version", UpdateManifest{Version: "0.2.13", SHA256: _hash, Signature: _valid}, _public, "signature verification failed"},
+		{"other hash", UpdateManifest{Version: "0.2.14", SHA256: "00" + _hash[2:], Signature: _valid}, _public, "signature verification failed"},
+		{"other platform", UpdateManifest{Version: "0.2.14", SHA256: _hash, Signature: _sign(fmt.Sprintf("0.2.14\n%s\n%s", _otherPlatform, _hash))}, _public, "signature verification failed"},
+		{"other key", UpdateManifest{Version: "0.2.14", SHA256: _hash, Signature: _valid}, _otherPublic, "signature verification failed"},
+		{"empty signature", UpdateManifest{Version: "0.2.14", SHA256: _hash}, _public, "signature verification failed"},
+		{"invalid encoding", UpdateManifest{Version: "0.2.14", SHA256: _hash, Signature: "not base64!"}, _public, "invalid signature encoding"},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			checkError(t, _tt.manifest.verify(_tt.key), _tt.want)
+		})
+	}
+}
+
+// -------------------------
+func TestGetUpdatePublicKey(t *testing.T) {
+	_public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_encoded := base64.StdEncoding.EncodeToString(_public)
+
+	_tests := []struct {
+		name       string
+		configured string
+		embedded   string
+		want       string
+	}{
+		{"from config", " " + _encoded + " ", "", ""},
+		{"config overrides embedded key", _encoded, "invalid", ""},
+		{"embedded key", "", _encoded, ""},
+		{"none", "", "", "no update public key configured"},
+		{"wrong length", base64.StdEncoding.EncodeToString(_public[:16]), "", "invalid update public key"},
+		{"not base64", "not base64!", "", "invalid update public key"},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			useConfig(t, Config{UpdatePublicKey: _tt.configured})
+			_previous := updatePublicKey
+			updatePublicKey = _tt.embedded
+			t.Cleanup(func() { updatePublicKey = _previous })
+
+			_key, err := getUpdatePublicKey()
+			checkError(t, err, _tt.want)
+			if err == nil && !_key.Equal(_public) {
+				t.Fatalf("got key %x, want %x", _key, _public)
+			}
+		})
+	}
+}
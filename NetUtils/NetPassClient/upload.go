@@ -0,0 +1,274 @@
+package main
+
+// -------------------------
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------------
+const uploadIdleTimeout = 60 * time.Second
+
+// 每個上傳 Session 暫存的上限，超過時中止上傳並回應 429，MQTT 訊息處理不會因本地服務讀取較慢而阻塞
+const maxUploadBuffer = 8 << 20
+const maxPendingChunks = 64
+
+// -------------------------
+var errUploadTimeout = errors.New("upload timed out waiting for next chunk")
+var errUploadAborted = errors.New("upload aborted")
+var errUploadOverflow = errors.New("upload buffer is full, the local service is not reading the body fast enough")
+
+// -------------------------
+// uploadSession 依 SessionID 收集分段上傳的請求主體，並依 Seq 排序後寫入本地請求
+type uploadSession struct {
+	key      string // <profile>/<SessionID>
+	log      *sessionLogger
+	base64   bool
+	reader   *io.PipeReader
+	writer   *io.PipeWriter
+	lock     sync.Mutex
+	ready    *sync.Cond
+	queue    [][]byte // 已排序、等待寫入 Pipe 的內容
+	buffered int      // queue 與寫入中的位元組數
+	next     int
+	pending  map[int]HttpRequestPayload
+	timer    *time.Timer
+	done     bool
+	err      error
+}
+
+// -------------------------
+var uploadLock sync.Mutex
+var uploadSessions = map[string]*uploadSession{}
+
+// -------------------------
+// isBase64Body 判斷請求主體是否為 Base64 編碼 (body_encoding 或與回應相同的 Content-Transfer-Encoding Header)
+func isBase64Body(payload HttpRequestPayload) bool {
+	if strings.EqualFold(payload.BodyEncoding, "base64") {
+		return true
+	}
+	for k, vv := range payload.Header {
+		if strings.EqualFold(k, "Content-Transfer-Encoding") {
+			for _, v := range vv {
+				if strings.EqualFold(strings.TrimSpace(v), "base64") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// -------------------------
+// decodeBody 依編碼方式還原請求主體
+func decodeBody(body string, isBase64 bool) ([]byte, error) {
+	if !isBase64 {
+		return []byte(body), nil
+	}
+	_data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 body: %v", err)
+	}
+	return _data, nil
+}
+
+// -------------------------
+// startUpload 建立分段上傳的 Session 並寫入第一段內容
+func (_this *Profile) startUpload(payload HttpRequestPayload) *uploadSession {
+	_reader, _writer := io.Pipe()
+	_session := &uploadSession{
+		key:     _this.uploadKey(payload),
+		log:     _this.sessionLog(payload.SessionID),
+		base64:  isBase64Body(payload),
+		reader:  _reader,
+		writer:  _writer,
+		pending: map[int]HttpRequestPayload{},
+	}
+	_session.ready = sync.NewCond(&_session.lock)
+	_session.timer = time.AfterFunc(uploadIdleTimeout, func() {
+		_session.log.Warnf("[Upload] Session timed out")
+		_session.abort(errUploadTimeout)
+	})
+
+	uploadLock.Lock()
+	if _old, ok := uploadSessions[_session.key]; ok {
+		defer _old.abort(errUploadAborted)
+	}
+	uploadSessions[_session.key] = _session
+	uploadLock.Unlock()
+
+	go _session.pump()
+	_session.feed(payload)
+	return _session
+}
+
+// -------------------------
+// uploadKey 以 profile 與 SessionID 區分上傳，不同伺服器的 SessionID 可能重複
+func (_this *Profile) uploadKey(payload HttpRequestPayload) string {
+	return _this.settings().ID + "/" + payload.SessionID
+}
+
+// -------------------------
+// feedUpload 將後續的分段內容交給對應的 Session
+func (_this *Profile) feedUpload(payload HttpRequestPayload) {
+	uploadLock.Lock()
+	_session, ok := uploadSessions[_this.uploadKey(payload)]
+	uploadLock.Unlock()
+
+	if !ok {
+		_this.sessionLog(payload.SessionID).Warnf("[Upload] Dropped chunk %d for unknown session", payload.Seq)
+		return
+	}
+	_session.feed(payload)
+}
+
+// -------------------------
+// pump 依序將分段內容寫入 Pipe，本地請求讀取速度較慢時在此等待
+func (_this *uploadSession) pump() {
+	for {
+		_this.lock.Lock()
+		for len(_this.queue) == 0 && !_this.done {
+			_this.ready.Wait()
+		}
+		if len(_this.queue) == 0 {
+			_this.lock.Unlock()
+			_this.writer.Close()
+			return
+		}
+		_data := _this.queue[0]
+		_this.queue[0] = nil
+		_this.queue = _this.queue[1:]
+		_this.lock.Unlock()
+
+		_, err := _this.writer.Write(_data)
+
+		_this.lock.Lock()
+		_this.buffered -= len(_data)
+		if err != nil {
+			// 讀取端已關閉，丟棄剩餘內容
+			_this.queue = nil
+			_this.buffered = 0
+			_this.lock.Unlock()
+			return
+		}
+		_this.lock.Unlock()
+	}
+}
+
+// -------------------------
+// feed 暫存分段內容，並將已連續的分段依序交給 pump，不會阻塞呼叫端
+// 暫存的內容或亂序的分段超過上限時中止上傳
+func (_this *uploadSession) feed(payload HttpRequestPayload) {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+
+	if _this.done {
+		return
+	}
+	_this.timer.Reset(uploadIdleTimeout)
+	if _, ok := _this.pending[payload.Seq]; !ok && len(_this.pending) >= maxPendingChunks {
+		_this.log.Warnf("[Upload] Too many out-of-order chunks, aborting")
+		_this.failLocked(errUploadOverflow)
+		return
+	}
+	_this.pending[payload.Seq] = payload
+
+	for {
+		_chunk, ok := _this.pending[_this.next]
+		if !ok {
+			return
+		}
+		delete(_this.pending, _this.next)
+		_this.next++
+
+		_data, err := decodeBody(_chunk.Body, _this.base64)
+		if err != nil {
+			_this.log.Warnf("[Upload] Chunk %d: %v", _chunk.Seq, err)
+			_this.failLocked(err)
+			return
+		}
+		if _this.buffered+len(_data) > maxUploadBuffer {
+			_this.log.Warnf("[Upload] Buffered body exceeds %d bytes, aborting", maxUploadBuffer)
+			_this.failLocked(errUploadOverflow)
+			return
+		}
+		if len(_data) > 0 {
+			_this.queue = append(_this.queue, _data)
+			_this.buffered += len(_data)
+			_this.ready.Signal()
+		}
+		if _chunk.Final {
+			_this.closeLocked()
+			return
+		}
+	}
+}
+
+// -------------------------
+// abort 中止上傳，本地請求讀取 Body 時會收到錯誤
+func (_this *uploadSession) abort(err error) {
+	// 先關閉 Pipe 讓 pump 不再阻塞，再取得 lock
+	_this.writer.CloseWithError(err)
+
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	if !_this.done {
+		_this.err = err
+		_this.closeLocked()
+	}
+}
+
+// -------------------------
+// failLocked 以指定的錯誤中止上傳，呼叫前須持有 lock
+// CloseWithError 會讓寫入中的 pump 立即返回，不需要等待 lock
+func (_this *uploadSession) failLocked(err error) {
+	_this.writer.CloseWithError(err)
+	_this.err = err
+	_this.closeLocked()
+}
+
+// -------------------------
+// failure 回傳上傳中止的原因，正常結束或尚未結束時為 nil
+func (_this *uploadSession) failure() error {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	return _this.err
+}
+
+// -------------------------
+// closeLocked 結束 Session 並從清單移除，呼叫前須持有 lock
+func (_this *uploadSession) closeLocked() {
+	_this.done = true
+	_this.timer.Stop()
+	_this.ready.Broadcast()
+
+	uploadLock.Lock()
+	if uploadSessions[_this.key] == _this {
+		delete(uploadSessions, _this.key)
+	}
+	uploadLock.Unlock()
+}
+
+// -------------------------
+// trackedReader 記錄 Body 是否已被讀取，尚未讀取時才能改用 HTTPS 重試
+// 讀到結尾時呼叫 onEOF (可為 nil)，分段上傳以此判斷主體已接收完畢
+type trackedReader struct {
+	io.Reader
+	used  bool
+	onEOF func()
+}
+
+// -------------------------
+func (_this *trackedReader) Read(b []byte) (int, error) {
+	_this.used = true
+	n, err := _this.Reader.Read(b)
+	if err == io.EOF && _this.onEOF != nil {
+		_this.onEOF()
+	}
+	return n, err
+}
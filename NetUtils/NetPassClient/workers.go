@@ -0,0 +1,332 @@
+package main
+
+// -------------------------
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// 以 WSS 隧道轉送原始 HTTP 的請求使用獨立的工作池，避免長時間的 Keep-Alive 佔用一般 HTTP 請求的名額
+const kindHTTPTunnel = "http_tunnel"
+
+// 預設在佇列中等待的上限
+const defaultQueueTimeout = 30 * time.Second
+
+// 送出拒絕回應的 goroutine 數量與待送出的上限，超過時丟棄，拒絕請求的成本不會隨請求量增加
+const rejectWorkers = 2
+const rejectQueueSize = 256
+
+// -------------------------
+var errSaturated = errors.New("client is saturated, request queue is full")
+var errQueueTimeout = errors.New("request waited too long in the queue")
+
+// -------------------------
+// PoolConfig 定義單一類型請求的並行上限與等待佇列長度
+type PoolConfig struct {
+	Concurrency int `json:"concurrency"` // 同時處理的請求數，至少為 1
+	Queue       int `json:"queue"`       // 等待處理的最大數量，0 代表不排隊，名額用完時直接拒絕
+}
+
+// -------------------------
+// WorkerConfig 定義各類型請求的工作池，未設定的類型使用預設值
+// 工作池由所有 profile 共用，限制的是整個 Client 的資源用量
+type WorkerConfig struct {
+	HTTP         *PoolConfig `json:"http"`          // 一般 HTTP 請求 (經由 MQTT 轉送)，預設 8 / 64
+	HTTPTunnel   *PoolConfig `json:"http_tunnel"`   // 以 WSS 隧道轉送的 HTTP 請求，預設 16 / 16
+	WebSocket    *PoolConfig `json:"websocket"`     // WebSocket 隧道，預設 32 / 32
+	TCP          *PoolConfig `json:"tcp"`           // TCP 隧道，預設 32 / 32
+	QueueTimeout string      `json:"queue_timeout"` // 在佇列中等待超過此時間即拒絕 (例如 "30s")，預設 30s
+}
+
+// -------------------------
+// poolTask 是等待中的請求
+type poolTask struct {
+	run    func()
+	reject func(status int, err error)
+	timer  *time.Timer
+}
+
+// -------------------------
+// workerPool 限制同一類型請求的並行數量，超過時排入佇列，佇列已滿則拒絕
+type workerPool struct {
+	kind     string
+	defaults PoolConfig
+	lock     sync.Mutex
+	limit    int
+	depth    int
+	timeout  time.Duration
+	running  int
+	queue    []*poolTask
+}
+
+// -------------------------
+var workerPools = map[string]*workerPool{
+	kindHTTP:       newWorkerPool(kindHTTP, PoolConfig{Concurrency: 8, Queue: 64}),
+	kindHTTPTunnel: newWorkerPool(kindHTTPTunnel, PoolConfig{Concurrency: 16, Queue: 16}),
+	kindWebSocket:  newWorkerPool(kindWebSocket, PoolConfig{Concurrency: 32, Queue: 32}),
+	kindTCP:        newWorkerPool(kindTCP, PoolConfig{Concurrency: 32, Queue: 32}),
+}
+
+// -------------------------
+var rejections = make(chan func(), rejectQueueSize)
+var startRejecters sync.Once
+
+// -------------------------
+func newWorkerPool(kind string, defaults PoolConfig) *workerPool {
+	return &workerPool{kind: kind, defaults: defaults, limit: defaults.Concurrency, depth: defaults.Queue, timeout: defaultQueueTimeout}
+}
+
+// -------------------------
+// poolConfig 回傳指定類型的設定，未設定時回傳 nil
+func (_this *WorkerConfig) poolConfig(kind string) *PoolConfig {
+	if _this == nil {
+		return nil
+	}
+	switch kind {
+	case kindHTTP:
+		return _this.HTTP
+	case kindHTTPTunnel:
+		return _this.HTTPTunnel
+	case kindWebSocket:
+		return _this.WebSocket
+	case kindTCP:
+		return _this.TCP
+	}
+	return nil
+}
+
+// -------------------------
+// queueTimeout 回傳在佇列中等待的上限
+func (_this *WorkerConfig) queueTimeout() time.Duration {
+	if _this == nil || _this.QueueTimeout == "" {
+		return defaultQueueTimeout
+	}
+	_timeout, err := time.ParseDuration(_this.QueueTimeout)
+	if err != nil || _timeout <= 0 {
+		return defaultQueueTimeout
+	}
+	return _timeout
+}
+
+// -------------------------
+// Validate 檢查工作池設定
+func (_this *WorkerConfig) Validate() error {
+	if _this == nil {
+		return nil
+	}
+	if err := validateDuration(_this.QueueTimeout); err != nil {
+		return fmt.Errorf("workers.queue_timeout: %v", err)
+	}
+	for _, _kind := range []string{kindHTTP, kindHTTPTunnel, kindWebSocket, kindTCP} {
+		_pool := _this.poolConfig(_kind)
+		if _pool == nil {
+			continue
+		}
+		if _pool.Concurrency < 1 {
+			return fmt.Errorf("workers.%s.concurrency: must be at least 1", _kind)
+		}
+		if _pool.Queue < 0 {
+			return fmt.Errorf("workers.%s.queue: must not be negative", _kind)
+		}
+	}
+	return nil
+}
+
+// -------------------------
+// applyWorkers 套用工作池設定，提高並行上限時立即處理佇列中的請求
+func applyWorkers(config *WorkerConfig) {
+	for _kind, _pool := range workerPools {
+		_settings := _pool.defaults
+		if _c := config.poolConfig(_kind); _c != nil {
+			_settings = *_c
+		}
+		_pool.resize(_settings, config.queueTimeout())
+	}
+}
+
+// -------------------------
+// resize 調整並行上限與佇列長度，已排隊的請求不受佇列縮短影響
+func (_this *workerPool) resize(settings PoolConfig, timeout time.Duration) {
+	_this.lock.Lock()
+	_this.limit = settings.Concurrency
+	_this.depth = settings.Queue
+	_this.timeout = timeout
+
+	var _start []func()
+	for _this.running < _this.limit && len(_this.queue) > 0 {
+		_start = append(_start, _this.popLocked())
+		_this.running++
+	}
+	_this.lock.Unlock()
+
+	for _, _run := range _start {
+		go _this.work(_run)
+	}
+}
+
+// -------------------------
+// submit 有空閒名額時立即執行，否則排入佇列；佇列已滿時以 429 拒絕，等待逾時則以 503 拒絕
+// reject 不可阻塞，呼叫端 (MQTT 訊息處理) 會直接執行
+func (_this *workerPool) submit(run func(), reject func(status int, err error)) {
+	_this.lock.Lock()
+	if _this.running < _this.limit {
+		_this.running++
+		_this.lock.Unlock()
+		go _this.work(run)
+		return
+	}
+	if len(_this.queue) >= _this.depth {
+		_this.lock.Unlock()
+		metricRejected.Inc(_this.kind, "saturated")
+		reject(http.StatusTooManyRequests, errSaturated)
+		return
+	}
+
+	_task := &poolTask{run: run, reject: reject}
+	_task.timer = time.AfterFunc(_this.timeout, func() {
+		if _this.remove(_task) {
+			metricRejected.Inc(_this.kind, "queue_timeout")
+			_task.reject(http.StatusServiceUnavailable, errQueueTimeout)
+		}
+	})
+	_this.queue = append(_this.queue, _task)
+	_this.lock.Unlock()
+}
+
+// -------------------------
+// work 執行請求，完成後繼續處理佇列中的下一筆
+func (_this *workerPool) work(run func()) {
+	for run != nil {
+		run()
+
+		_this.lock.Lock()
+		run = nil
+		if _this.running <= _this.limit && len(_this.queue) > 0 {
+			run = _this.popLocked()
+		} else {
+			_this.running--
+		}
+		_this.lock.Unlock()
+	}
+}
+
+// -------------------------
+// popLocked 取出佇列中最早的請求，呼叫前須持有 lock
+func (_this *workerPool) popLocked() func() {
+	_task := _this.queue[0]
+	_this.queue[0] = nil
+	_this.queue = _this.queue[1:]
+	_task.timer.Stop()
+	return _task.run
+}
+
+// -------------------------
+// remove 將請求移出佇列，已開始執行時回傳 false
+func (_this *workerPool) remove(task *poolTask) bool {
+	_this.lock.Lock()
+	defer _this.lock.Unlock()
+	for i, _t := range _this.queue {
+		if _t == task {
+			_this.queue = append(_this.queue[:i], _this.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------------
+// rejectQueued 拒絕所有佇列中的請求 (關閉中)
+func rejectQueued(err error) {
+	for _, _pool := range workerPools {
+		_pool.lock.Lock()
+		_tasks := _pool.queue
+		_pool.queue = nil
+		_pool.lock.Unlock()
+
+		for _, _task := range _tasks {
+			_task.timer.Stop()
+			metricRejected.Inc(_pool.kind, "draining")
+			_task.reject(http.StatusServiceUnavailable, err)
+		}
+	}
+}
+
+// -------------------------
+// queueReject 將拒絕回應交給固定數量的 goroutine 送出，待送出的拒絕已滿時直接丟棄
+// 被丟棄的請求由伺服器端等待逾時處理
+func queueReject(reject func()) {
+	startRejecters.Do(func() {
+		for i := 0; i < rejectWorkers; i++ {
+			go func() {
+				for _reject := range rejections {
+					_reject()
+				}
+			}()
+		}
+	})
+
+	select {
+	case rejections <- reject:
+	default:
+		logDebugf("Reject queue is full, dropping rejection")
+	}
+}
+
+// -------------------------
+// writePoolMetrics 輸出各工作池執行中與等待中的請求數
+func writePoolMetrics(w io.Writer) {
+	_kinds := sortedKeys(workerPools)
+
+	fmt.Fprintf(w, "# HELP netpass_worker_busy Requests currently being handled by each worker pool.\n# TYPE netpass_worker_busy gauge\n")
+	for _, _kind := range _kinds {
+		_pool := workerPools[_kind]
+		_pool.lock.Lock()
+		fmt.Fprintf(w, "netpass_worker_busy{kind=%q} %d\n", _kind, _pool.running)
+		_pool.lock.Unlock()
+	}
+	fmt.Fprintf(w, "# HELP netpass_worker_queued Requests waiting for a free worker by kind.\n# TYPE netpass_worker_queued gauge\n")
+	for _, _kind := range _kinds {
+		_pool := workerPools[_kind]
+		_pool.lock.Lock()
+		fmt.Fprintf(w, "netpass_worker_queued{kind=%q} %d\n", _kind, len(_pool.queue))
+		_pool.lock.Unlock()
+	}
+}
+
+// -------------------------
+// dispatch 將請求交給對應類型的工作池，被拒絕時執行 abort (可為 nil) 並以 queueReject 通知伺服器
+func (_this *Profile) dispatch(kind string, payload HttpRequestPayload, run func(), abort func()) {
+	workerPools[kind].submit(run, func(status int, err error) {
+		if abort != nil {
+			abort()
+		}
+		_this.sessionLog(payload.SessionID).Warnf("Rejected %s request: %v", kind, err)
+		queueReject(func() { _this.rejectRequest(payload, status, err) })
+	})
+}
+
+// -------------------------
+// rejectRequest 拒絕尚未處理的請求，一般請求發布錯誤回應，隧道請求連上後以 Close Code 1013 關閉
+// 由 queueReject 的固定數量 goroutine 執行，拒絕再多也不會同時建立大量隧道連線
+func (_this *Profile) rejectRequest(payload HttpRequestPayload, status int, err error) {
+	_reason := fmt.Sprintf("%d %s: %v", status, http.StatusText(status), err)
+	switch payload.Action {
+	case "tunnel", "tcp_tunnel", "http_tunnel":
+		_this.rejectTunnel(payload, websocket.CloseTryAgainLater, _reason)
+	default:
+		_this.publishResponse(HttpResponsePayload{
+			StatusCode: status,
+			Status:     _reason,
+			Header:     map[string][]string{"Retry-After": {"1"}},
+			HardwareID: _this.assignedID(),
+			SessionID:  payload.SessionID,
+		})
+	}
+}
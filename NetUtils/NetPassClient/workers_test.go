@@ -0,0 +1,180 @@
+package main
+
+// -------------------------
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+// -------------------------
+// rejection 記錄一筆被拒絕的請求
+type rejection struct {
+	index  int
+	status int
+	err    error
+}
+
+// -------------------------
+func TestWorkerPoolSubmit(t *testing.T) {
+	_tests := []struct {
+		name    string
+		pool    PoolConfig
+		timeout time.Duration
+		submits int
+		want    []rejection // 依序被拒絕的請求
+	}{
+		{"free workers", PoolConfig{Concurrency: 2, Queue: 0}, time.Minute, 2, nil},
+		{"queued", PoolConfig{Concurrency: 1, Queue: 2}, time.Minute, 3, nil},
+		{"no queue", PoolConfig{Concurrency: 1, Queue: 0}, time.Minute, 2, []rejection{
+			{1, http.StatusTooManyRequests, errSaturated},
+		}},
+		{"full queue", PoolConfig{Concurrency: 1, Queue: 1}, time.Minute, 4, []rejection{
+			{2, http.StatusTooManyRequests, errSaturated},
+			{3, http.StatusTooManyRequests, errSaturated},
+		}},
+		{"queue timeout", PoolConfig{Concurrency: 1, Queue: 1}, 50 * time.Millisecond, 2, []rejection{
+			{1, http.StatusServiceUnavailable, errQueueTimeout},
+		}},
+	}
+	for _, _tt := range _tests {
+		t.Run(_tt.name, func(t *testing.T) {
+			_pool := newWorkerPool(kindHTTP, _tt.pool)
+			_pool.timeout = _tt.timeout
+
+			_release := make(chan struct{})
+			_ran := make(chan int, _tt.submits)
+			_rejected := make(chan rejection, _tt.submits)
+			for i := 0; i < _tt.submits; i++ {
+				_index := i
+				_pool.submit(func() {
+					<-_release
+					_ran <- _index
+				}, func(status int, err error) {
+					_rejected <- rejection{_index, status, err}
+				})
+			}
+
+			for _, _want := range _tt.want {
+				select {
+				case _got := <-_rejected:
+					if _got.index != _want.index || _got.status != _want.status || !errors.Is(_got.err, _want.err) {
+						t.Fatalf("got rejection %+v, want %+v", _got, _want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("request %d was not rejected", _want.index)
+				}
+			}
+
+			// 放行後其餘的請求 (含排隊中的) 都要執行完畢
+			close(_release)
+			for i := 0; i < _tt.submits-len(_tt.want); i++ {
+				select {
+				case <-_ran:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d of %d accepted requests ran", i, _tt.submits-len(_tt.want))
+				}
+			}
+			if len(_rejected) > 0 {
+				t.Fatalf("unexpected rejection %+v", <-_rejected)
+			}
+		})
+	}
+}
+
+// -------------------------
+// fakeMQTT 記錄發布的訊息，其餘方法不會被呼叫
+type fakeMQTT struct {
+	mqtt.Client
+	published chan []byte
+}
+
+// -------------------------
+type fakeToken struct {
+	mqtt.Token
+}
+
+// -------------------------
+func (_this *fakeMQTT) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	_this.published <- payload.([]byte)
+	return fakeToken{}
+}
+
+// -------------------------
+func (fakeToken) Wait() bool { return true }
+
+// -------------------------
+// 佇列已滿時，伺服器必須收到 429 回應，而不是等待逾時
+func TestDispatchFullQueue(t *testing.T) {
+	_previous := workerPools[kindHTTP]
+	workerPools[kindHTTP] = newWorkerPool(kindHTTP, PoolConfig{Concurrency: 1, Queue: 0})
+	t.Cleanup(func() { workerPools[kindHTTP] = _previous })
+
+	_client := &fakeMQTT{published: make(chan []byte, 1)}
+	_profile := &Profile{client: _client}
+	_profile.config.Store(&ProfileConfig{ID: "test"})
+
+	_release := make(chan struct{})
+	defer close(_release)
+	_profile.dispatch(kindHTTP, HttpRequestPayload{SessionID: "busy"}, func() { <-_release }, nil)
+
+	_aborted := make(chan struct{})
+	_profile.dispatch(kindHTTP, HttpRequestPayload{SessionID: "rejected"}, func() {
+		t.Error("request ran although the pool was full")
+	}, func() { close(_aborted) })
+
+	select {
+	case <-_aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abort was not called for the rejected request")
+	}
+
+	select {
+	case _data := <-_client.published:
+		var _response HttpResponsePayload
+		if err := json.Unmarshal(_data, &_response); err != nil {
+			t.Fatal(err)
+		}
+		if _response.SessionID != "rejected" || _response.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("got response %d for session %q, want 429 for \"rejected\"", _response.StatusCode, _response.SessionID)
+		}
+		if len(_response.Header["Retry-After"]) == 0 {
+			t.Fatal("rejection has no Retry-After header")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rejection was published")
+	}
+}
+
+// -------------------------
+// 被拒絕的隧道請求要連上隧道並以 1013 關閉，原因帶有狀態碼
+func TestRejectTunnel(t *testing.T) {
+	useConfig(t, Config{Mux: true})
+	_session, _peer := newTestMux(t)
+	_profile := _session.profile
+	_profile.mux = _session
+
+	_profile.rejectRequest(HttpRequestPayload{Action: "tcp_tunnel", Token: "rejected"}, http.StatusTooManyRequests, errSaturated)
+
+	_open := _peer.read()
+	if _open.frameType != muxFrameOpen || string(_open.payload) != "rejected" {
+		t.Fatalf("got frame %d %q, want OPEN \"rejected\"", _open.frameType, _open.payload)
+	}
+	_close := _peer.read()
+	if _close.frameType != muxFrameClose || _close.id != _open.id || len(_close.payload) < 2 {
+		t.Fatalf("got frame %d/%d %q, want CLOSE/%d", _close.frameType, _close.id, _close.payload, _open.id)
+	}
+	if _code := int(binary.BigEndian.Uint16(_close.payload)); _code != websocket.CloseTryAgainLater {
+		t.Fatalf("got close code %d, want %d", _code, websocket.CloseTryAgainLater)
+	}
+	if _reason := string(_close.payload[2:]); !strings.HasPrefix(_reason, "429 ") {
+		t.Fatalf("close reason %q does not carry the status", _reason)
+	}
+}